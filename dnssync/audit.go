@@ -0,0 +1,62 @@
+package dnssync
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+// auditChange logs an audit entry for the applied correction c to dc: what
+// changed, from what to what, and the rules and droplets whose records it
+// wrote. Deletions remove records no rule produces, so they name neither.
+func auditChange(dc *models.DomainConfig, c *models.Correction) {
+	p := parseCorrection(dc.Name, c)
+	attrs := []interface{}{"zone", dc.Name, "action", p.Action, "type", p.Type, "name", p.Name}
+	if p.Old != "" {
+		attrs = append(attrs, "old", p.Old)
+	}
+	if p.New != "" {
+		attrs = append(attrs, "new", p.New)
+	}
+	rules, drops := correctionSources(dc, c)
+	if len(rules) > 0 {
+		attrs = append(attrs, "rule", strings.Join(rules, ","))
+	}
+	if len(drops) > 0 {
+		attrs = append(attrs, "droplet", strings.Join(drops, ","))
+	}
+	if p.Action == "" {
+		attrs = append(attrs, "correction", c.Msg)
+	}
+	slog.Info("Applied DNS change", attrs...)
+}
+
+// correctionSources returns the ids of the rules and the names of the
+// droplets that produced the records of dc c writes, sorted.
+func correctionSources(dc *models.DomainConfig, c *models.Correction) ([]string, []string) {
+	name, typ := canonicalName(correctionName(c)), correctionType(c)
+	rules, drops := map[string]bool{}, map[string]bool{}
+	for _, rec := range dc.Records {
+		if rec.Type != typ || rec.NameFQDN != name && rec.Name != name {
+			continue
+		}
+		if id := rec.Metadata["rule"]; id != "" {
+			rules[id] = true
+		}
+		if drop := rec.Metadata["droplet"]; drop != "" {
+			drops[drop] = true
+		}
+	}
+	return sortedKeys(rules), sortedKeys(drops)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
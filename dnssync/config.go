@@ -0,0 +1,134 @@
+package dnssync
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Config selects what a Sync does. Everything else, like NO_DELETE or
+// MAX_DELETES, is read from the environment as for the do-dns-sync binary.
+type Config struct {
+	// Token is the DigitalOcean API token. Empty uses DO_TOKEN. It is
+	// ignored when DO_REFRESH_TOKEN is set.
+	Token string
+	// Rules is the path or http(s) URL of the names config, in the JSON
+	// format if it ends in .json. Empty uses NAMES_CFG, or
+	// names.cfg.
+	Rules string
+	// Version identifies the caller in the API user agent.
+	Version string
+	// Report receives the change report. Nil uses REPORT_OUTPUT, or the log
+	// under LOG_FORMAT=json.
+	Report io.Writer
+
+	// Interval is how long Run waits between syncs. Zero uses
+	// SYNC_INTERVAL.
+	Interval time.Duration
+	// TTL is the TTL of records whose rule and zone give none. Zero uses
+	// DEFAULT_TTL, or 100.
+	TTL uint32
+
+	// Zone, when set, limits the sync to records in this zone.
+	Zone string
+	// OnlyRule and OnlyTag limit the sync to the records of the rule with
+	// this id and of rules matching this droplet tag. Deletions are held.
+	OnlyRule string
+	OnlyTag  string
+
+	// Interactive asks on stdin before applying a zone's deletions.
+	Interactive bool
+	// Prune limits deletions to records this tool has synced, so records
+	// made by hand in a zone are left alone.
+	Prune bool
+	// Reconcile applies deletions despite NO_DELETE, REPORT_DELETES,
+	// append-only zones and deletion caps.
+	Reconcile bool
+	// Plan writes the changes a sync would make as JSON on stdout instead
+	// of applying them.
+	Plan bool
+	// DryRun reports the changes a sync would make, as [DRY-RUN] lines,
+	// instead of applying them.
+	DryRun bool
+	// Export writes the computed records to this dnscontrol file, JSON if
+	// it ends in .json and dnsconfig.js otherwise, instead of applying them.
+	Export string
+	// ZoneFile writes the computed records as BIND zone files on stdout
+	// instead of applying them.
+	ZoneFile bool
+}
+
+// Summary describes what a Sync did.
+type Summary struct {
+	// Applied lists the corrections applied, as "zone: correction".
+	Applied []string
+	// Planned is the number of changes a Plan or DryRun sync found.
+	Planned int
+	// Skipped is the number of records rules matched a droplet for but
+	// couldn't produce.
+	Skipped int
+	// Droplets is the number of droplets records were computed for.
+	Droplets int
+	// Zones is the number of zones records were computed for.
+	Zones int
+
+	skipped []skippedRecord
+}
+
+// cfg is the Config of the call in progress.
+var cfg Config
+
+// configure checks c and makes it the Config of the call in progress.
+func configure(c Config) error {
+	if privatePrefer != "" && privatePrefer != "vpc" && privatePrefer != "legacy" {
+		return categorize(ErrConfig, fmt.Errorf("PRIVATE_IP_PREFER must be 'vpc' or 'legacy', not '%s'", privatePrefer))
+	}
+	if defaultTTL <= 0 || defaultTTL > math.MaxInt32 {
+		return categorize(ErrConfig, fmt.Errorf("DEFAULT_TTL must be a positive number of seconds, not %d", defaultTTL))
+	}
+	if c.TTL > math.MaxInt32 {
+		return categorize(ErrConfig, fmt.Errorf("TTL must be at most %d, not %d", math.MaxInt32, c.TTL))
+	}
+	if _, ok := reportLevels[reportVerbosity]; !ok {
+		return categorize(ErrConfig, fmt.Errorf("REPORT_VERBOSITY must be 'errors', 'changes' or 'all', not '%s'", reportVerbosity))
+	}
+	w := c.Report
+	if w == nil {
+		var err error
+		if w, err = reportOutputWriter(); err != nil {
+			return categorize(ErrConfig, fmt.Errorf("Error opening REPORT_OUTPUT: %s", err))
+		}
+	}
+	if c.Plan && w == os.Stdout {
+		// Keep stdout for the JSON plan.
+		w = os.Stderr
+	}
+	report = w
+	reportJSON = c.Report == nil && logFormat == "json"
+	token = c.Token
+	if token == "" {
+		token = os.Getenv("DO_TOKEN")
+	}
+	namesCfg = c.Rules
+	if namesCfg == "" {
+		namesCfg = envOr("NAMES_CFG", "names.cfg")
+	}
+	cfg = c
+	return nil
+}
+
+// planning reports whether the call in progress only plans its changes.
+func planning() bool {
+	return cfg.Plan || cfg.DryRun
+}
+
+// userAgent identifies this tool in DigitalOcean API requests.
+func userAgent() string {
+	v := cfg.Version
+	if v == "" {
+		v = "dev"
+	}
+	return "do-dns-sync/" + v
+}
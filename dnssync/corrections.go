@@ -0,0 +1,444 @@
+package dnssync
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+func isDelete(c *models.Correction) bool {
+	return strings.HasPrefix(c.Msg, "DELETE")
+}
+
+// reportDeletes, like NO_DELETE, never applies deletions, but reports each
+// record it would have deleted as stale and counts them per zone, so drift
+// can be audited and cleaned up by hand.
+var reportDeletes = os.Getenv("REPORT_DELETES") != ""
+
+// filterCorrections drops the corrections to dc this tool never applies:
+// any correction to an ignored name or, under TXT_OWNER_ID, to a name this
+// instance doesn't own, deletions of the zone's NS records, deletions of
+// records outside the zone's manage-regex or not synced by this tool under
+// Prune, any deletion when NO_DELETE, REPORT_DELETES or holdDeletes is set
+// or the zone is append-only, and TTL-only changes when IGNORE_TTL_DRIFT is
+// set.
+func filterCorrections(dc *models.DomainConfig, corrs []*models.Correction, holdDeletes bool) []*models.Correction {
+	zone := dc.Name
+	var held map[string]bool
+	if txtOwnerID != "" {
+		held = heldNames(dc, corrs)
+	}
+	kept := []*models.Correction{}
+	stale, drift := 0, 0
+	defer func() {
+		if reportDeletes {
+			staleRecords.WithLabelValues(zone).Set(float64(stale))
+		}
+		driftRecords.WithLabelValues(zone).Set(float64(drift))
+	}()
+	for _, c := range corrs {
+		if zoneCfg.ignored(correctionName(c)) {
+			reportChange(dc, reportAll, "IGNORED", c, nil, "IGNORED", c.Msg)
+			continue
+		}
+		if strings.Contains(c.Msg, "DELETE NS") {
+			continue
+		}
+		if ignoreTTLDrift && ttlOnly(c) {
+			continue
+		}
+		if zoneCfg.AppendOnly[zone] && !cfg.Reconcile && isDelete(c) {
+			continue
+		}
+		if re := zoneCfg.Manage[zone]; re != nil && isDelete(c) && !re.MatchString(canonicalName(correctionName(c))) {
+			// Not ours to delete.
+			continue
+		}
+		if cfg.Prune && isDelete(c) && !ownsRecord(zone, c) {
+			reportChange(dc, reportAll, "KEPT (not synced by do-dns-sync)", c, nil, "KEPT (not synced by do-dns-sync)", c.Msg)
+			continue
+		}
+		if held[ownedName(correctionName(c))] {
+			reportChange(dc, reportAll, "KEPT (not owned by "+txtOwnerID+")", c, nil, "KEPT (not owned by "+txtOwnerID+")", c.Msg)
+			continue
+		}
+		drift++
+		if reportDeletes && !cfg.Reconcile && isDelete(c) {
+			reportChange(dc, reportChanges, "STALE (REPORT_DELETES)", c, nil, "STALE (REPORT_DELETES)", c.Msg)
+			stale++
+			continue
+		}
+		if (noDelete || zoneCfg.Sync.NoDelete) && !cfg.Reconcile && isDelete(c) {
+			reportChange(dc, reportChanges, "SKIPPED (NO_DELETE)", c, nil, "SKIPPED (NO_DELETE)", c.Msg)
+			continue
+		}
+		if holdDeletes && isDelete(c) {
+			reportChange(dc, reportChanges, "SKIPPED (deletions held)", c, nil, "SKIPPED (deletions held)", c.Msg)
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept
+}
+
+// ignoreTTLDrift drops corrections that would only change a record's TTL,
+// for when TTLs are managed elsewhere.
+var ignoreTTLDrift = os.Getenv("IGNORE_TTL_DRIFT") != ""
+
+var ttlField = regexp.MustCompile(`\s*\bttl=\d+`)
+
+// ttlOnly reports whether c modifies nothing but a record's TTL.
+func ttlOnly(c *models.Correction) bool {
+	p := parseCorrection("", c)
+	if p.Action != "MODIFY" || p.Old == "" {
+		return false
+	}
+	return ttlField.ReplaceAllString(p.Old, "") == ttlField.ReplaceAllString(p.New, "")
+}
+
+// maxDeletes and maxZoneDeletes cap how many deletions one sync may apply
+// in total and in a single zone. Zero means no cap.
+var (
+	maxDeletes     = envInt("MAX_DELETES", 0)
+	maxZoneDeletes = envInt("MAX_ZONE_DELETES", 0)
+)
+
+// maxZoneRecords, when set, is the most records the rules may produce in a
+// zone. A zone with more isn't synced at all, since a regex matching far
+// more droplets than intended shouldn't flood it.
+var maxZoneRecords = envInt("MAX_ZONE_RECORDS", 0)
+
+// tooManyRecords reports, logging why, whether dc has more records than
+// MAX_ZONE_RECORDS allows.
+func tooManyRecords(dc *models.DomainConfig) bool {
+	if maxZoneRecords <= 0 || len(dc.Records) <= maxZoneRecords {
+		return false
+	}
+	slog.Error("Refusing to sync zone: the rules produce more records than MAX_ZONE_RECORDS", "zone", dc.Name, "records", len(dc.Records), "max", maxZoneRecords)
+	return true
+}
+
+// capDeletes drops all of a zone's deletions if applying them would go over
+// either cap, logging each for review and reporting true. deleted is the
+// running total of deletions allowed so far this sync.
+func capDeletes(dc *models.DomainConfig, corrs []*models.Correction, deleted *int) ([]*models.Correction, bool) {
+	zone := dc.Name
+	n := 0
+	for _, c := range corrs {
+		if isDelete(c) {
+			n++
+		}
+	}
+	if n == 0 || cfg.Reconcile {
+		return corrs, false
+	}
+	overZone := maxZoneDeletes > 0 && n > maxZoneDeletes
+	overTotal := maxDeletes > 0 && *deleted+n > maxDeletes
+	if !overZone && !overTotal {
+		*deleted += n
+		return corrs, false
+	}
+	slog.Warn("Refusing deletions over MAX_ZONE_DELETES or MAX_DELETES", "zone", zone, "deletes", n, "max_zone_deletes", maxZoneDeletes, "max_deletes", maxDeletes)
+	kept := []*models.Correction{}
+	for _, c := range corrs {
+		if isDelete(c) {
+			reportChange(dc, reportChanges, "SKIPPED (deletion cap)", c, nil, "SKIPPED (deletion cap)", c.Msg)
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept, true
+}
+
+// confirm lists corrs and asks on stdin whether to apply them to zone if
+// any of them is a deletion. It always says yes outside interactive mode.
+func confirm(zone string, corrs []*models.Correction) bool {
+	if !cfg.Interactive {
+		return true
+	}
+	hasDelete := false
+	for _, c := range corrs {
+		if isDelete(c) {
+			hasDelete = true
+			break
+		}
+	}
+	if !hasDelete {
+		return true
+	}
+	msgs := make([]string, 0, len(corrs))
+	for _, c := range corrs {
+		msgs = append(msgs, c.Msg)
+	}
+	return ask("Corrections for "+zone+" include deletions:", msgs)
+}
+
+// ask prints header and lines and asks on stdin whether to apply them.
+func ask(header string, lines []string) bool {
+	fmt.Println(header)
+	for _, line := range lines {
+		fmt.Println("  ", line)
+	}
+	fmt.Print("Apply them? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// correctionRules returns a note naming the rules that produced the records
+// c mentions, matched by name, or "" if none of them have ids.
+func correctionRules(dc *models.DomainConfig, c *models.Correction) string {
+	fields := map[string]bool{}
+	for _, f := range strings.Fields(c.Msg) {
+		fields[strings.TrimSuffix(f, ".")] = true
+	}
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, rec := range dc.Records {
+		id := rec.Metadata["rule"]
+		if id == "" || seen[id] || !(fields[rec.NameFQDN] || fields[rec.Name]) {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	return " [rule " + strings.Join(ids, ",") + "]"
+}
+
+// maxApplyConcurrency is how many corrections within a zone may be applied
+// at once. Corrections for the same name are always applied in order.
+var maxApplyConcurrency = envInt("MAX_APPLY_CONCURRENCY", 1)
+
+// correctionName returns the record name a correction acts on, taken from
+// its message ("CREATE A www.example.com ..."), or "" if it can't tell.
+func correctionName(c *models.Correction) string {
+	fields := strings.Fields(c.Msg)
+	if len(fields) < 3 {
+		return ""
+	}
+	return strings.TrimSuffix(fields[2], ":")
+}
+
+// correctionType returns the record type a correction acts on, like A in
+// "CREATE A www.example.com ...", or "" if it can't tell.
+func correctionType(c *models.Correction) string {
+	fields := strings.Fields(c.Msg)
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[1]
+}
+
+// applyOrder lists record types in the order their corrections are applied
+// within a zone, so A records can exist before the SRV records pointing at
+// them. Unlisted types go last, in the order the provider gave them. With
+// MAX_APPLY_CONCURRENCY above 1 the order is only the order they start in.
+var applyOrder = splitList(os.Getenv("APPLY_ORDER"))
+
+// correctionDepths returns the depth of each of corrs, given the rule depths
+// from ruleDepths: the deepest of the rules that produced the records it
+// names. Deletions name no produced records, so they have depth 0.
+func correctionDepths(dc *models.DomainConfig, corrs []*models.Correction, depths map[string]int) map[*models.Correction]int {
+	depth := map[*models.Correction]int{}
+	for _, c := range corrs {
+		name := canonicalName(correctionName(c))
+		for _, rec := range dc.Records {
+			if rec.NameFQDN == name && depths[rec.Metadata["rule"]] > depth[c] {
+				depth[c] = depths[rec.Metadata["rule"]]
+			}
+		}
+	}
+	return depth
+}
+
+// orderCorrections sorts corrs so the records of a rule's depends= come
+// before its own, by correctionDepths, and then by applyOrder.
+func orderCorrections(dc *models.DomainConfig, corrs []*models.Correction, depths map[string]int) {
+	rank := map[string]int{}
+	for i, t := range applyOrder {
+		rank[strings.ToUpper(t)] = i + 1
+	}
+	typeKey := func(c *models.Correction) int {
+		if r, ok := rank[correctionType(c)]; ok {
+			return r
+		}
+		return len(applyOrder) + 1
+	}
+	depth := correctionDepths(dc, corrs, depths)
+	sort.SliceStable(corrs, func(i, j int) bool {
+		if depth[corrs[i]] != depth[corrs[j]] {
+			return depth[corrs[i]] < depth[corrs[j]]
+		}
+		return typeKey(corrs[i]) < typeKey(corrs[j])
+	})
+}
+
+// zoneConcurrency is how many zones a sync computes and applies the
+// corrections of at once. Interactive syncs go one zone at a time.
+var zoneConcurrency = envInt("ZONE_CONCURRENCY", 1)
+
+// syncZones calls syncZone for each zone of domains, up to zoneConcurrency
+// at once. It stops starting zones after the first error, which it
+// returns, or when ctx is done.
+func syncZones(ctx context.Context, domains map[string]*models.DomainConfig, syncZone func(*models.DomainConfig) error) error {
+	workers := zoneConcurrency
+	if workers < 1 || cfg.Interactive {
+		workers = 1
+	}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	work := make(chan *models.DomainConfig)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dc := range work {
+				mu.Lock()
+				stop := firstErr != nil
+				mu.Unlock()
+				if stop {
+					continue
+				}
+				err := ctx.Err()
+				if err == nil {
+					err = syncZone(dc)
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, dc := range domains {
+		work <- dc
+	}
+	close(work)
+	wg.Wait()
+	return firstErr
+}
+
+// applyZone applies corrs to dc one depth of correctionDepths at a time,
+// so the records of a rule's depends= are written before its own, running
+// up to maxApplyConcurrency groups of same-named corrections of a depth in
+// parallel. It stops starting new corrections after the first failure and
+// returns the ones that were applied. DNS writes can't be made atomic, so
+// after a failure it reports which corrections were applied, which failed
+// and which were never attempted, for recovery by hand or on the next sync.
+func applyZone(ctx context.Context, dc *models.DomainConfig, corrs []*models.Correction, depths map[string]int) ([]string, error) {
+	depth := correctionDepths(dc, corrs, depths)
+	levels := []int{}
+	groups := map[int][][]*models.Correction{}
+	index := map[string]int{}
+	for _, c := range corrs {
+		d := depth[c]
+		key := fmt.Sprintf("%d %s", d, correctionName(c))
+		i, ok := index[key]
+		if !ok {
+			if len(groups[d]) == 0 {
+				levels = append(levels, d)
+			}
+			i = len(groups[d])
+			index[key] = i
+			groups[d] = append(groups[d], nil)
+		}
+		groups[d][i] = append(groups[d][i], c)
+	}
+	sort.Ints(levels)
+	workers := maxApplyConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		applied  []string
+		firstErr error
+		failed   []*models.Correction
+		started  = map[*models.Correction]bool{}
+	)
+	apply := func(work chan []*models.Correction) {
+		defer wg.Done()
+		for group := range work {
+			for _, c := range group {
+				mu.Lock()
+				stop := firstErr != nil
+				if !stop {
+					started[c] = true
+				}
+				mu.Unlock()
+				if stop {
+					break
+				}
+				err := applyCorrection(ctx, c)
+				mu.Lock()
+				switch {
+				case err != nil:
+					reportChange(dc, reportErrors, "FAILED", c, err, c.Msg+correctionRules(dc, c), err)
+				case c.F == nil:
+					reportChange(dc, reportAll, "INFO", c, nil, c.Msg)
+				default:
+					if !reportJSON {
+						// Under LOG_FORMAT=json the audit entry is the report.
+						reportln(dc.Name, reportChanges, c.Msg+correctionRules(dc, c))
+					}
+					auditChange(dc, c)
+				}
+				if err != nil {
+					failed = append(failed, c)
+					if firstErr == nil {
+						firstErr = fmt.Errorf("%s%s: %w", c.Msg, correctionRules(dc, c), err)
+					}
+				} else if c.F != nil {
+					applied = append(applied, dc.Name+": "+c.Msg)
+				}
+				mu.Unlock()
+			}
+		}
+	}
+	for _, d := range levels {
+		// Each depth starts once the one before it is done.
+		work := make(chan []*models.Correction)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go apply(work)
+		}
+		for _, group := range groups[d] {
+			work <- group
+		}
+		close(work)
+		wg.Wait()
+		if firstErr != nil {
+			break
+		}
+	}
+	if firstErr != nil {
+		reportln(dc.Name, reportErrors, fmt.Sprintf("%s partially updated: %d of %d corrections applied, %d failed", dc.Name, len(applied), len(corrs), len(failed)))
+		for _, c := range failed {
+			reportChange(dc, reportErrors, "FAILED", c, nil, "FAILED", c.Msg)
+		}
+		for _, c := range corrs {
+			if !started[c] {
+				reportChange(dc, reportErrors, "NOT ATTEMPTED", c, nil, "NOT ATTEMPTED", c.Msg)
+			}
+		}
+	}
+	return applied, firstErr
+}
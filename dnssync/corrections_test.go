@@ -0,0 +1,66 @@
+package dnssync
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+func TestApplyZoneDependsConcurrent(t *testing.T) {
+	defer func(n int) { maxApplyConcurrency = n }(maxApplyConcurrency)
+	maxApplyConcurrency = 4
+	rec := func(name, rule string) *models.RecordConfig {
+		return &models.RecordConfig{Type: "A", NameFQDN: name, Metadata: map[string]string{"rule": rule}}
+	}
+	dc := &models.DomainConfig{Name: "ssdv.win", Records: []*models.RecordConfig{
+		rec("db1.ssdv.win", "db"), rec("db2.ssdv.win", "db"),
+		rec("api.ssdv.win", "api"),
+		rec("www.ssdv.win", "web"),
+	}}
+	depths := map[string]int{"db": 0, "api": 1, "web": 2}
+	var mu sync.Mutex
+	finished := map[string]time.Time{}
+	started := map[string]time.Time{}
+	corr := func(name string, d time.Duration) *models.Correction {
+		return &models.Correction{Msg: "CREATE A " + name + " 1.2.3.4 ttl=100", F: func() error {
+			mu.Lock()
+			started[name] = time.Now()
+			mu.Unlock()
+			time.Sleep(d)
+			mu.Lock()
+			finished[name] = time.Now()
+			mu.Unlock()
+			return nil
+		}}
+	}
+	// Given out of order, with the dependencies slowest.
+	corrs := []*models.Correction{
+		corr("www.ssdv.win", 0),
+		corr("api.ssdv.win", 20*time.Millisecond),
+		corr("db1.ssdv.win", 40*time.Millisecond),
+		corr("db2.ssdv.win", 40*time.Millisecond),
+	}
+	done, err := applyZone(context.Background(), dc, corrs, depths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(corrs) {
+		t.Fatalf("applied %d of %d corrections", len(done), len(corrs))
+	}
+	for _, pair := range [][2]string{
+		{"db1.ssdv.win", "api.ssdv.win"},
+		{"db2.ssdv.win", "api.ssdv.win"},
+		{"api.ssdv.win", "www.ssdv.win"},
+	} {
+		if !started[pair[1]].After(finished[pair[0]]) {
+			t.Errorf("%s started before %s, which it depends on, finished", pair[1], pair[0])
+		}
+	}
+	// The two records of the same depth still run at once.
+	if !started["db2.ssdv.win"].Before(finished["db1.ssdv.win"]) && !started["db1.ssdv.win"].Before(finished["db2.ssdv.win"]) {
+		t.Error("corrections of the same depth ran one after the other")
+	}
+}
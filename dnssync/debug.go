@@ -0,0 +1,224 @@
+package dnssync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/godo"
+)
+
+// TestDroplet prints the records the rules produce for the droplet named
+// arg, or for a JSON droplet read from stdin if arg is "-", without touching
+// the API. The droplet stands in for an instance of every source, so rules
+// with source= can be tried too.
+func TestDroplet(c Config, arg string) error {
+	if err := configure(c); err != nil {
+		return err
+	}
+	drop := godo.Droplet{Name: arg}
+	if arg == "-" {
+		drop = godo.Droplet{}
+		if err := json.NewDecoder(os.Stdin).Decode(&drop); err != nil {
+			return fmt.Errorf("Reading droplet JSON from stdin: %s", err)
+		}
+	}
+	ctx := context.Background()
+	rules, err := LoadRules(ctx)
+	if err != nil {
+		return err
+	}
+	nameMap, err := LoadNameMap()
+	if err != nil {
+		return err
+	}
+	insts := map[string][]Instance{}
+	for _, name := range sourceNames {
+		insts[name] = []Instance{{Droplet: drop, Source: name}}
+	}
+	domains, skips, err := desiredState(ctx, nil, enabledRules(rules), insts, nameMap)
+	if err != nil {
+		return err
+	}
+	skips.log()
+	for _, dc := range sortedZones(domains) {
+		fmt.Println("-----", dc.Name)
+		for _, rec := range dc.Records {
+			fmt.Println(recordString(rec))
+		}
+	}
+	for _, r := range pendingRenames {
+		fmt.Printf("rename %s to %s for reverse DNS\n", r.From, r.To)
+	}
+	return nil
+}
+
+// ruleLine formats r as a config line with every option spelled out.
+func ruleLine(r *NameRule) string {
+	parts := []string{r.Type, r.FQDN, r.Target}
+	if r.Type == "TXT" {
+		parts[2] = quoteTXT(r.Target)
+	}
+	if r.Disabled {
+		parts[0] = "!" + r.Type
+	}
+	if r.Label != "" {
+		parts = append(parts, "["+r.Label+"]")
+	}
+	if r.Regex != nil {
+		parts = append(parts, "`"+r.Regex.String()+"`")
+	}
+	opt := func(key, value string) {
+		if value != "" {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	opt("id", r.ID)
+	opt("provider", r.Provider)
+	opt("ttl", strconv.FormatUint(uint64(r.TTL), 10))
+	if r.Type == "SRV" {
+		opt("port", strconv.Itoa(r.Port))
+		if r.WeightFrom != "" {
+			opt("weight", r.WeightFrom)
+		} else {
+			opt("weight", strconv.Itoa(int(r.SrvWeight)))
+		}
+		opt("priority", strconv.Itoa(int(r.SrvPriority)))
+		opt("service", r.Service)
+		opt("proto", r.Proto)
+	}
+	if r.Type == "MX" {
+		opt("priority", strconv.Itoa(int(r.MxPreference)))
+	}
+	opt("name", r.DropletName)
+	opt("region", r.Region)
+	opt("feature", r.Feature)
+	opt("source", r.Source)
+	opt("project", r.Project)
+	opt("vpc", r.VPC)
+	if r.PublicCIDR != nil {
+		opt("pub4cidr", r.PublicCIDR.String())
+	}
+	opt("meta", r.MetaURL)
+	opt("zone", r.Zone)
+	opt("fallback", r.Fallback)
+	opt("depends", strings.Join(r.Depends, ","))
+	if r.Flatten {
+		parts = append(parts, "flatten")
+	}
+	if r.PTR {
+		parts = append(parts, "ptr")
+	}
+	if r.Aggregate {
+		parts = append(parts, "aggregate")
+	}
+	keys := make([]string, 0, len(r.Meta))
+	for k := range r.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		opt("meta:"+k, r.Meta[k])
+	}
+	keys = keys[:0]
+	for k := range r.TagRegex {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		opt("tag:"+k, "`"+r.TagRegex[k].String()+"`")
+	}
+	return strings.Join(parts, " ")
+}
+
+// PrintConfig prints the rules and zone settings as they were parsed, with
+// defaults and includes applied.
+func PrintConfig(c Config) error {
+	if err := configure(c); err != nil {
+		return err
+	}
+	rules, err := LoadRules(context.Background())
+	if err != nil {
+		return err
+	}
+	if s := zoneCfg.Sync; s != (syncSettings{}) {
+		// The line format has no sync options, so they're printed as a
+		// comment.
+		line := "# sync"
+		if s.Interval > 0 {
+			line += " interval=" + s.Interval.String()
+		}
+		if s.TTL > 0 {
+			line += fmt.Sprintf(" ttl=%d", s.TTL)
+		}
+		for _, opt := range []struct {
+			name string
+			on   bool
+		}{{"dry_run", s.DryRun}, {"prune", s.Prune}, {"no_delete", s.NoDelete}} {
+			if opt.on {
+				line += " " + opt.name
+			}
+		}
+		fmt.Println(line)
+	}
+	if zoneCfg.Allowed != nil {
+		zones := []string{}
+		for zone := range zoneCfg.Allowed {
+			zones = append(zones, zone)
+		}
+		sort.Strings(zones)
+		fmt.Println("zones", strings.Join(zones, " "))
+	}
+	zones := map[string]bool{}
+	for zone := range zoneCfg.TTLs {
+		zones[zone] = true
+	}
+	for zone := range zoneCfg.AppendOnly {
+		zones[zone] = true
+	}
+	for zone := range zoneCfg.Manage {
+		zones[zone] = true
+	}
+	names := []string{}
+	for zone := range zones {
+		names = append(names, zone)
+	}
+	sort.Strings(names)
+	for _, zone := range names {
+		line := "zone " + zone
+		if ttl, ok := zoneCfg.TTLs[zone]; ok {
+			line += fmt.Sprintf(" ttl=%d", ttl)
+		}
+		if appendOnly, ok := zoneCfg.AppendOnly[zone]; ok {
+			if appendOnly {
+				line += " policy=append-only"
+			} else {
+				line += " policy=full"
+			}
+		}
+		if re, ok := zoneCfg.Manage[zone]; ok {
+			line += " manage-regex=`" + re.String() + "`"
+		}
+		fmt.Println(line)
+	}
+	for _, f := range zoneCfg.Excluded {
+		fmt.Println("exclude", f)
+	}
+	if len(zoneCfg.Ignored) > 0 {
+		fmt.Println("ignore", strings.Join(zoneCfg.Ignored, " "))
+	}
+	for i := 0; i < len(rules); i++ {
+		line := ruleLine(rules[i])
+		// A private twin follows the rule that asked for it with private=.
+		if i+1 < len(rules) && rules[i+1].PrivateLabel != "" && rules[i+1].FQDN == rules[i].FQDN {
+			line += " private=" + rules[i+1].PrivateLabel
+			i++
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
@@ -0,0 +1,1144 @@
+// Package dnssync keeps DNS records in sync with DigitalOcean droplets, as
+// names config rules describe. It is the core of the do-dns-sync binary.
+package dnssync
+
+import (
+	"context"
+	"errors"
+
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/StackExchange/dnscontrol/providers/cloudflare"
+	"github.com/StackExchange/dnscontrol/providers/digitalocean"
+	_ "github.com/StackExchange/dnscontrol/providers/route53"
+	"github.com/miekg/dns/dnsutil"
+
+	"github.com/StackExchange/dnscontrol/models"
+	"github.com/StackExchange/dnscontrol/providers"
+	"github.com/digitalocean/godo"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/oauth2"
+)
+
+var token = os.Getenv("DO_TOKEN")
+
+// recordComment, when set, is a template for a comment kept with each
+// record, like "managed by do-dns-sync, rule=$RULE, droplet=$DROP". It takes
+// the variables of the record's rule, and $RULE for the rule's id. A comment
+// using a variable the record has no value for is left off; ${RULE:-none}
+// covers rules without an id.
+var recordComment = os.Getenv("RECORD_COMMENT")
+
+// noDelete skips every delete correction, leaving the tool able to only
+// create or modify records.
+var noDelete = os.Getenv("NO_DELETE") != ""
+
+// dropSeparator, when set, replaces dots in droplet names substituted for
+// $DROP so a name like web.prod.01 does not create a deep subdomain.
+var dropSeparator = os.Getenv("DROP_SEPARATOR")
+
+// namePrefix and nameSuffix are added to every record's name relative to
+// its zone, so one config can produce a separate record set per environment.
+// Apex records are left alone.
+var (
+	namePrefix = os.Getenv("NAME_PREFIX")
+	nameSuffix = os.Getenv("NAME_SUFFIX")
+)
+
+// minTTL is the lowest TTL any record may be given. A TTL of 0 leaves the
+// choice to the provider and is never clamped.
+var minTTL = uint32(envInt("MIN_TTL", 0))
+
+// maxTTL, when set, is the highest TTL any record may be given.
+var maxTTL = uint32(envInt("MAX_TTL", 0))
+
+// defaultTTL is the TTL of records whose rule and zone give none, unless
+// Config.TTL is set.
+var defaultTTL = envInt("DEFAULT_TTL", 100)
+
+// globalTTL returns the TTL of records whose rule and zone give none.
+func globalTTL() uint32 {
+	if cfg.TTL > 0 {
+		return cfg.TTL
+	}
+	return uint32(defaultTTL)
+}
+
+// ttlStep gives records of droplets at least age old a TTL.
+type ttlStep struct {
+	age time.Duration
+	ttl uint32
+}
+
+// ttlByAge, from TTL_BY_AGE like "0s:30,1h:300,24h:3600", gives records of
+// young droplets short TTLs that lengthen as they settle. It applies to
+// rules without their own ttl=.
+var ttlByAge = envTTLSteps("TTL_BY_AGE")
+
+func envTTLSteps(key string) []ttlStep {
+	var steps []ttlStep
+	for _, s := range splitList(os.Getenv(key)) {
+		kv := strings.SplitN(s, ":", 2)
+		if len(kv) != 2 {
+			log.Fatalf("Invalid %s step '%s': want age:ttl", key, s)
+		}
+		age, err := time.ParseDuration(kv[0])
+		if err != nil {
+			log.Fatalf("Invalid %s age '%s': %s", key, kv[0], err)
+		}
+		ttl, err := strconv.ParseUint(kv[1], 10, 32)
+		if err != nil {
+			log.Fatalf("Invalid %s TTL '%s': %s", key, kv[1], err)
+		}
+		steps = append(steps, ttlStep{age, uint32(ttl)})
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].age < steps[j].age })
+	return steps
+}
+
+// ageTTL returns the TTL ttlByAge gives drop, if any step applies.
+func ageTTL(drop godo.Droplet) (uint32, bool) {
+	created, err := time.Parse(time.RFC3339, drop.Created)
+	if err != nil {
+		return 0, false
+	}
+	age := time.Since(created)
+	ttl, ok := uint32(0), false
+	for _, step := range ttlByAge {
+		if age >= step.age {
+			ttl, ok = step.ttl, true
+		}
+	}
+	return ttl, ok
+}
+
+// warnUnmatched logs droplets that no rule matched, to catch gaps like a
+// mistyped tag.
+var warnUnmatched = os.Getenv("WARN_UNMATCHED") != ""
+
+// skipForeignZones skips, with a warning, zones that aren't domains in the
+// token's DigitalOcean account, instead of failing the sync on them.
+var skipForeignZones = os.Getenv("SKIP_FOREIGN_ZONES") != ""
+
+// correctionTimeout bounds how long a single DNS write may take.
+var correctionTimeout = envDuration("CORRECTION_TIMEOUT", time.Minute)
+
+// errCorrectionTimeout is the error of a correction that took longer than
+// correctionTimeout.
+var errCorrectionTimeout = errors.New("Timed out")
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s '%s': %s", key, v, err)
+	}
+	return d
+}
+
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s '%s': %s", key, v, err)
+	}
+	return i
+}
+
+type TokenSource struct {
+	AccessToken string
+}
+
+func (t *TokenSource) Token() (*oauth2.Token, error) {
+	token := &oauth2.Token{
+		AccessToken: t.AccessToken,
+	}
+	return token, nil
+}
+
+// refreshToken, when set, is an OAuth refresh token used with the client
+// id and secret to get access tokens from oauthTokenURL, renewing them as
+// they expire, instead of the fixed DO_TOKEN.
+var (
+	refreshToken      = os.Getenv("DO_REFRESH_TOKEN")
+	oauthClientID     = os.Getenv("DO_CLIENT_ID")
+	oauthClientSecret = os.Getenv("DO_CLIENT_SECRET")
+	oauthTokenURL     = envOr("DO_TOKEN_URL", "https://cloud.digitalocean.com/v1/oauth/token")
+)
+
+// refreshingTokens is kept across syncs so each access token, and the
+// refresh token that may replace refreshToken with it, is reused until it
+// expires.
+var refreshingTokens oauth2.TokenSource
+
+// tokenSource returns the source of DigitalOcean access tokens.
+func tokenSource() oauth2.TokenSource {
+	if refreshToken == "" {
+		return &TokenSource{AccessToken: token}
+	}
+	if refreshingTokens == nil {
+		conf := &oauth2.Config{
+			ClientID:     oauthClientID,
+			ClientSecret: oauthClientSecret,
+			Endpoint:     oauth2.Endpoint{TokenURL: oauthTokenURL},
+		}
+		// With no access token, the first use gets one.
+		refreshingTokens = conf.TokenSource(context.Background(), &oauth2.Token{RefreshToken: refreshToken})
+	}
+	return refreshingTokens
+}
+
+// newClient returns a godo client whose requests are counted in the
+// running sync's calls.
+func newClient() (*godo.Client, error) {
+	countRequests()
+	oauthClient := oauth2.NewClient(context.Background(), tokenSource())
+	return godo.New(oauthClient, godo.SetUserAgent(userAgent()))
+}
+
+func runOnce(ctx context.Context, sum *Summary) (err error) {
+	planned = []plannedChange{}
+	calls := &callCounter{}
+	syncCalls.Store(calls)
+	client, err := newClient()
+	if err != nil {
+		return categorize(ErrListing, err)
+	}
+	defer func() {
+		syncCalls.Store(nil)
+		n := calls.count()
+		slog.Info("Made DigitalOcean API calls", "calls", n)
+		apiCalls.Add(float64(n))
+		lastAPICalls.Set(float64(n))
+	}()
+
+	rules, err := LoadRules(ctx)
+	if err != nil {
+		return categorize(ErrConfig, err)
+	}
+	nameMap, err := LoadNameMap()
+	if err != nil {
+		return categorize(ErrConfig, err)
+	}
+	if len(rules) == 0 {
+		slog.Warn("No rules loaded, so no records are being managed", "config", namesCfg)
+	} else if len(enabledRules(rules)) == 0 {
+		slog.Warn("All rules are disabled, so no records are being managed", "config", namesCfg, "rules", len(rules))
+	}
+	depths, err := ruleDepths(rules)
+	if err != nil {
+		return categorize(ErrConfig, err)
+	}
+	rules = supportedRules(enabledRules(rules))
+	filter := onlyFilter()
+	if filter != "" {
+		rules = onlyRules(rules)
+		slog.Info("Only syncing the matching rules; deletions are held", "only", filter, "rules", len(rules))
+		defer slog.Info("Filtered run: only the matching rules were synced", "only", filter)
+	}
+
+	// evaluate lists the droplets and computes the desired state from them,
+	// reporting whether deletions must be held.
+	evaluate := func() (map[string]*models.DomainConfig, *skipReport, bool, error) {
+		insts, err := listInstances(ctx, client, rules)
+		dropletsListed.Set(float64(len(bySource(insts)[sourceDroplets])))
+		var holdDeletes bool
+		if err != nil {
+			if !allowPartialListing || len(insts) == 0 {
+				return nil, nil, false, categorize(ErrListing, err)
+			}
+			slog.Warn("Droplet listing stopped early, holding deletions this cycle", "listed", len(insts), "error", err)
+			holdDeletes = true
+		} else {
+			holdDeletes = dropletsShrank(len(bySource(insts)[sourceDroplets]))
+		}
+		// Records of the rules left out would look like deletions.
+		holdDeletes = holdDeletes || filter != ""
+		if insts, err = filterInstances(ctx, insts); err != nil {
+			return nil, nil, false, categorize(ErrConfig, err)
+		}
+		checkIPv6(rules, insts)
+		insts = canaryDroplets(insts)
+		sum.Droplets = len(bySource(insts)[sourceDroplets])
+		domains, skips, err := desiredState(ctx, client, rules, bySource(insts), nameMap)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if len(rules) > 0 && filter == "" {
+			addAbandonedZones(domains)
+		}
+		addOwnerRecords(domains)
+		return domains, skips, holdDeletes, nil
+	}
+	domains, skips, holdDeletes, err := evaluate()
+	if err != nil {
+		return err
+	}
+	if settlePeriod > 0 && !planning() && desiredChanged(domains) {
+		slog.Info("Desired records changed, waiting for them to settle", "settle", settlePeriod)
+		if err := sleep(ctx, settlePeriod); err != nil {
+			return err
+		}
+		if domains, skips, holdDeletes, err = evaluate(); err != nil {
+			return err
+		}
+	}
+	if settlePeriod > 0 {
+		markDesired(domains)
+	}
+	publishSkipped(skips)
+	defer skips.log()
+	sum.Skipped = len(skips.records)
+	sum.Zones = len(domains)
+	sum.skipped = skips.records
+	if cfg.Export != "" {
+		publishState(domains)
+		return writeExport(cfg.Export, domains)
+	}
+	if cfg.ZoneFile {
+		publishState(domains)
+		_, err := os.Stdout.Write(bindZones(domains))
+		return err
+	}
+	var owned map[string]bool
+	if skipForeignZones {
+		if owned, err = accountDomains(ctx, client); err != nil {
+			return categorize(ErrListing, err)
+		}
+	}
+	provs := map[string]providers.DNSServiceProvider{}
+	applied := []string{}
+	// The hook runs for whatever was applied, even when a later zone or
+	// the renames failed.
+	defer func() { runPostApply(ctx, applied, err) }()
+	deletes := 0
+	// mu guards provs, applied, deletes and the per-zone state and plan
+	// when ZONE_CONCURRENCY syncs several zones at once.
+	var mu sync.Mutex
+	// syncZone computes the corrections to dc and applies them.
+	syncZone := func(dc *models.DomainConfig) error {
+		name := zoneProvider(dc)
+		if owned != nil && name == defaultProvider && !owned[dc.Name] {
+			slog.Warn("Skipping zone: it isn't a domain in this DigitalOcean account", "zone", dc.Name)
+			return nil
+		}
+		reportHeader(dc.Name)
+		var err error
+		mu.Lock()
+		provider := provs[name]
+		if provider == nil {
+			if provider, err = providerFactories[name](); err == nil {
+				provs[name] = provider
+			}
+		}
+		mu.Unlock()
+		if err != nil {
+			return categorize(ErrProvider, err)
+		}
+		if tooManyRecords(dc) {
+			return nil
+		}
+		preflight(dc, name)
+		mu.Lock()
+		unchanged := !planning() && zoneUnchanged(dc)
+		mu.Unlock()
+		if unchanged {
+			reportln(dc.Name, reportAll, "Unchanged since last sync")
+			return nil
+		}
+		corrs, err := provider.GetDomainCorrections(dc)
+		if err != nil {
+			return categorize(ErrProvider, err)
+		}
+		corrs = filterCorrections(dc, corrs, holdDeletes)
+		mu.Lock()
+		corrs, refused := capDeletes(dc, corrs, &deletes)
+		mu.Unlock()
+		orderCorrections(dc, corrs, depths)
+		if planning() {
+			mu.Lock()
+			for _, c := range corrs {
+				planCorrection(dc, c)
+			}
+			mu.Unlock()
+			reportPlanCounts(dc.Name, corrs)
+			return nil
+		}
+		if !confirm(dc.Name, corrs) {
+			reportln(dc.Name, reportChanges, "Skipping", dc.Name)
+			return nil
+		}
+		done, err := applyZone(ctx, dc, corrs, depths)
+		if err != nil && isConflict(err) && !cfg.Interactive {
+			// Someone else changed the zone since the corrections were
+			// computed, so compute them again and retry once.
+			slog.Warn("Conflict applying zone, retrying with fresh corrections", "zone", dc.Name, "error", err)
+			corrs, err = provider.GetDomainCorrections(dc)
+			if err == nil {
+				var again bool
+				corrs = filterCorrections(dc, corrs, holdDeletes)
+				mu.Lock()
+				corrs, again = capDeletes(dc, corrs, &deletes)
+				mu.Unlock()
+				refused = refused || again
+				orderCorrections(dc, corrs, depths)
+				var more []string
+				more, err = applyZone(ctx, dc, corrs, depths)
+				done = append(done, more...)
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		applied = append(applied, done...)
+		if err != nil {
+			return categorize(ErrProvider, err)
+		}
+		markZoneOwned(dc, done)
+		if !holdDeletes && !refused {
+			markZoneSynced(dc)
+			markZoneManaged(dc)
+		}
+		return nil
+	}
+	if err := syncZones(ctx, domains, syncZone); err != nil {
+		return err
+	}
+	if err := applyRenames(ctx, client); err != nil {
+		return categorize(ErrProvider, err)
+	}
+	publishState(domains)
+	sum.Applied = applied
+	if planning() {
+		sum.Planned = len(planned)
+		if cfg.Plan {
+			return writePlan()
+		}
+		return nil
+	}
+	return nil
+}
+
+// desiredState computes the records rules produce for insts, the instances
+// of each source by name, grouped into zones, along with the records rules
+// matched but couldn't produce.
+func desiredState(ctx context.Context, client *godo.Client, rules []*NameRule, insts map[string][]Instance, nameMap map[string]string) (map[string]*models.DomainConfig, *skipReport, error) {
+	cutoff, err := createdCutoff()
+	if err != nil {
+		return nil, nil, categorize(ErrConfig, err)
+	}
+
+	vpcs := &vpcCache{ctx: ctx, client: client, ranges: map[string]*net.IPNet{}}
+	projects := &projectCache{ctx: ctx, client: client, members: map[string]map[string]bool{}}
+	floating := &floatingCache{ctx: ctx, client: client}
+	metas := &metadataCache{ctx: ctx, values: map[string]string{}, errs: map[string]error{}}
+	resolver := &resolverCache{ctx: ctx, addrs: map[string][]net.IP{}, errs: map[string]error{}}
+	domains := map[string]*models.DomainConfig{}
+	skips := newSkipReport()
+	shortNames, realNames := ptrShortNames(rules, insts[sourceDroplets])
+	insts = withInstances(insts, sourceDroplets, shortNames)
+	pendingRenames = map[int]ptrRename{}
+	// ptrNamed holds the droplets a ptr rule already chose a name for.
+	ptrNamed := map[int]bool{}
+	sets := map[*NameRule]map[string][]*models.RecordConfig{}
+	peers := dropletIPs(insts[sourceDroplets])
+
+	rules = referencesLast(rules)
+	// evaluate adds the records rules produce for drops. Fallback rules are
+	// evaluated once, against no droplet, so only literal names and targets
+	// produce records.
+	evaluate := func(rules []*NameRule, insts []Instance, fallback bool) error {
+		for _, inst := range insts {
+			drop := inst.Droplet
+			if !fallback && !cutoff.IsZero() && createdBefore(drop, cutoff) {
+				continue
+			}
+			if !fallback && zoneCfg.excluded(drop) {
+				continue
+			}
+			// produced holds the name each rule with an id generated for this
+			// droplet, for targets that reference it as @id.
+			produced := map[string]string{}
+			matched := false
+			for _, rule := range rules {
+				var part string
+				if rule.Label != "" {
+					var ok bool
+					if part, ok = matchLabel(drop, rule.Label); !ok {
+						continue
+					}
+				}
+				if rule.DropletName != "" && drop.Name != rule.DropletName {
+					continue
+				}
+				if rule.Region != "" && (drop.Region == nil || drop.Region.Slug != rule.Region) {
+					continue
+				}
+				if rule.Feature != "" && !hasFeature(drop, rule.Feature) {
+					continue
+				}
+				if rule.Project != "" {
+					in, err := projects.contains(rule.Project, drop)
+					if err != nil {
+						return categorize(ErrListing, err)
+					}
+					if !in {
+						continue
+					}
+				}
+				var matches []string
+				if rule.Regex != nil {
+					matches = rule.Regex.FindStringSubmatch(drop.Name)
+					if len(matches) == 0 {
+						continue
+					}
+				}
+				tagged, ok := tagGroups(rule, drop)
+				if !ok {
+					continue
+				}
+				matched = true
+				groups := regexGroups(rule, matches)
+				for k, v := range tagged {
+					groups[k] = v
+				}
+				vars := map[string]string{}
+				if strings.Contains(rule.FQDN+rule.Target, "$MAP") {
+					mapped, ok := nameMap[drop.Name]
+					if !ok {
+						continue
+					}
+					vars["$MAP"] = mapped
+				} else if strings.Contains(rule.FQDN+rule.Target, "${MAP") {
+					// Unmapped droplets get the default.
+					vars["$MAP"] = nameMap[drop.Name]
+				}
+				vars["$TAGPART"] = part
+				for _, m := range dropIPVar.FindAllStringSubmatch(rule.FQDN+" "+rule.Target, -1) {
+					// Unknown droplets leave it empty, skipping the record.
+					vars["$DROPIP:"+m[1]] = peers[m[1]]
+				}
+				if rule.MetaURL != "" {
+					url, ok := replace(rule.MetaURL, drop, groups, vars)
+					if !ok {
+						skips.add(rule, drop.Name, rule.FQDN, skipMissingVariable, "meta URL uses a variable the droplet has no value for")
+						continue
+					}
+					meta, err := metas.get(url)
+					if err != nil {
+						skips.add(rule, drop.Name, rule.FQDN, skipNoMetadata, "%s", err)
+						continue
+					}
+					vars["$META"] = meta
+				}
+				if rule.PublicCIDR != nil {
+					vars["$PUB4"] = ipv4In(drop, "public", rule.PublicCIDR)
+				}
+				if rule.VPC == "" && privatePrefer != "" && drop.VPCUUID != "" && len(privateIPv4s(drop)) > 1 {
+					cidr, err := vpcs.ipRange(drop.VPCUUID)
+					if err != nil {
+						return categorize(ErrListing, err)
+					}
+					vars["$PRI4"] = preferredPrivateIPv4(drop, cidr)
+				}
+				if strings.Contains(rule.FQDN+rule.Target, "$VPCRANGE") || strings.Contains(rule.FQDN+rule.Target, "${VPCRANGE") {
+					// Droplets outside a VPC have no $VPCRANGE, so their
+					// records are skipped.
+					vars["$VPCRANGE"] = ""
+					if drop.VPCUUID != "" {
+						cidr, err := vpcs.ipRange(drop.VPCUUID)
+						if err != nil {
+							return categorize(ErrListing, err)
+						}
+						vars["$VPCRANGE"] = cidr.String()
+					}
+				}
+				if strings.Contains(rule.FQDN+rule.Target, "$FLOAT") || strings.Contains(rule.FQDN+rule.Target, "${FLOAT") {
+					ip, err := floating.ip(drop)
+					if err != nil {
+						return categorize(ErrListing, err)
+					}
+					if ip == "" && !strings.Contains(rule.FQDN+rule.Target, "${FLOAT:-") {
+						skips.add(rule, drop.Name, rule.FQDN, skipMissingVariable, "droplet %s has no floating IP", drop.Name)
+						continue
+					}
+					vars["$FLOAT"] = ip
+				}
+				if rule.VPC != "" {
+					cidr, err := vpcs.ipRange(rule.VPC)
+					if err != nil {
+						return categorize(ErrListing, err)
+					}
+					vars["$PRI4"] = ipv4In(drop, "private", cidr)
+					if vars["$PRI4"] == "" && strings.Contains(rule.FQDN+rule.Target, "$PRI4") {
+						skips.add(rule, drop.Name, rule.FQDN, skipNoPrivateIP, "no private IP in VPC %s", rule.VPC)
+						continue
+					}
+				}
+				for _, tmplName := range rule.Names() {
+					name, ok := replace(tmplName, drop, groups, vars)
+					if !ok {
+						skips.add(rule, drop.Name, tmplName, skipMissingVariable, "name uses a variable the droplet has no value for")
+						continue
+					}
+					fqdn, err := idna.ToASCII(name)
+					if err != nil {
+						skips.add(rule, drop.Name, name, skipBadName, "%s", err)
+						continue
+					}
+					fqdn = canonicalName(fqdn)
+					for _, tmpl := range rule.Targets() {
+						target, ok := replace(tmpl, drop, groups, vars)
+						if !ok {
+							skips.add(rule, drop.Name, fqdn, skipMissingVariable, "target %s uses a variable the droplet has no value for", tmpl)
+							continue
+						}
+						if strings.HasPrefix(tmpl, "@") {
+							ref, ok := produced[tmpl[1:]]
+							if !ok {
+								skips.add(rule, drop.Name, fqdn, skipMissingRef, "rule %s produced no name", tmpl[1:])
+								continue
+							}
+							target = ref + "."
+						}
+						if rule.Type == "SRV" || rule.Type == "CNAME" || rule.Type == "MX" {
+							if target, err = idna.ToASCII(target); err != nil {
+								skips.add(rule, drop.Name, fqdn, skipBadTarget, "%s", err)
+								continue
+							}
+							// Host name targets are always fully qualified.
+							target = canonicalName(target) + "."
+						}
+						rec := &models.RecordConfig{
+							Type:     rule.Type,
+							NameFQDN: fqdn,
+							Target:   target,
+							TTL:      rule.TTL,
+						}
+						// DigitalOcean records have no comment field, so provenance
+						// lives in the record metadata, which providers that support
+						// annotations and the exports carry through.
+						rec.Metadata = map[string]string{}
+						for k, v := range rule.Meta {
+							rec.Metadata[k] = v
+						}
+						rec.Metadata["managed-by"] = "do-dns-sync"
+						if rule.ID != "" {
+							rec.Metadata["rule"] = rule.ID
+						}
+						if drop.Name != "" {
+							rec.Metadata["droplet"] = drop.Name
+						}
+						if recordComment != "" {
+							commentVars := map[string]string{"$RULE": rule.ID}
+							for k, v := range vars {
+								commentVars[k] = v
+							}
+							if comment, ok := replace(recordComment, drop, groups, commentVars); ok {
+								rec.Metadata["comment"] = comment
+							}
+						}
+						sld, err := zoneFor(rule, rec.NameFQDN)
+						if err != nil {
+							skips.add(rule, drop.Name, rec.NameFQDN, skipNoZone, "%s", err)
+							continue
+						}
+						if !zoneSelected(sld) {
+							continue
+						}
+						if !zoneCfg.zoneAllowed(sld) {
+							skips.add(rule, drop.Name, rec.NameFQDN, skipZoneNotAllowed, "zone %s is not in the zones list", sld)
+							continue
+						}
+						if ttl, ok := zoneCfg.TTLs[sld]; ok && !rule.TTLSet {
+							rec.TTL = ttl
+						}
+						if ttl, ok := ageTTL(drop); ok && !rule.TTLSet {
+							rec.TTL = ttl
+						}
+						if rec.TTL != 0 && rec.TTL < minTTL {
+							rule.logf(slog.LevelInfo, "Raising TTL of %s %s from %d to MIN_TTL %d", rec.Type, rec.NameFQDN, rec.TTL, minTTL)
+							rec.TTL = minTTL
+						}
+						if maxTTL != 0 && rec.TTL > maxTTL {
+							rule.logf(slog.LevelInfo, "Lowering TTL of %s %s from %d to MAX_TTL %d", rec.Type, rec.NameFQDN, rec.TTL, maxTTL)
+							rec.TTL = maxTTL
+						}
+						if lim := providerLimits[rule.Provider].MinTTL; rec.TTL != 0 && rec.TTL < lim {
+							rule.logf(slog.LevelInfo, "Raising TTL of %s %s from %d to the %s minimum of %d", rec.Type, rec.NameFQDN, rec.TTL, rule.Provider, lim)
+							rec.TTL = lim
+						}
+						rec.Name = dnsutil.TrimDomainName(rec.NameFQDN, sld)
+						if rule.PrivateLabel != "" {
+							if rec.Name == "@" {
+								rec.Name = rule.PrivateLabel
+							} else {
+								rec.Name += "." + rule.PrivateLabel
+							}
+							rec.NameFQDN = rec.Name + "." + sld
+						}
+						if rec.Name != "@" && (namePrefix != "" || nameSuffix != "") {
+							rec.Name = namePrefix + rec.Name + nameSuffix
+							rec.NameFQDN = rec.Name + "." + sld
+						}
+						// Checked on the final name, as the diff sees it.
+						if zoneCfg.ignored(rec.NameFQDN) {
+							skips.add(rule, drop.Name, rec.NameFQDN, skipIgnored, "name is ignored")
+							continue
+						}
+						if err := checkNameLength(rec.NameFQDN); err != nil {
+							skips.add(rule, drop.Name, rec.NameFQDN, skipNameTooLong, "%s", err)
+							continue
+						}
+						if rule.Type == "SRV" {
+							rec.SrvPort = uint16(rule.Port)
+							rec.SrvWeight = srvWeight(rule, drop)
+							rec.SrvPriority = rule.SrvPriority
+						}
+						if rule.Type == "TXT" {
+							rec.TxtStrings = []string{rec.Target}
+						}
+						if rule.Type == "MX" {
+							rec.MxPreference = rule.MxPreference
+						}
+						if rule.Type == "CNAME" && !rule.Flatten && rec.NameFQDN == sld {
+							skips.add(rule, drop.Name, rec.NameFQDN, skipBadName, "a CNAME can't be at the zone apex; use flatten")
+							continue
+						}
+						if rule.PTR && !ptrNamed[drop.ID] {
+							ptrNamed[drop.ID] = true
+							if want := strings.TrimSuffix(rec.NameFQDN, "."); !strings.EqualFold(realNames[drop.ID], want) {
+								pendingRenames[drop.ID] = ptrRename{ID: drop.ID, From: realNames[drop.ID], To: want}
+							}
+						}
+						recs := []*models.RecordConfig{rec}
+						if rule.Flatten {
+							if recs, err = resolver.flatten(rec); err != nil {
+								skips.add(rule, drop.Name, rec.NameFQDN, skipUnresolved, "%s", err)
+								continue
+							}
+						}
+						if rule.Aggregate {
+							recs = aggregate(sets, rule, recs)
+						}
+						if domains[sld] == nil {
+							domains[sld] = &models.DomainConfig{
+								Name:         sld,
+								DNSProviders: map[string]int{rule.Provider: 0},
+							}
+						} else if p := zoneProvider(domains[sld]); p != rule.Provider {
+							return categorize(ErrConfig, fmt.Errorf("Zone %s is assigned to both %s and %s providers", sld, p, rule.Provider))
+						}
+						domains[sld].Records = append(domains[sld].Records, recs...)
+						for _, rec := range recs {
+							skips.produce(rule, rec)
+						}
+						if _, ok := produced[rule.ID]; rule.ID != "" && !ok {
+							produced[rule.ID] = rec.NameFQDN
+						}
+					}
+				}
+			}
+			if warnUnmatched && !matched && !fallback {
+				slog.Warn("Droplet matched no rules", "droplet", drop.Name)
+			}
+		}
+		return nil
+	}
+	primaries, fallbacks := splitFallbacks(rules)
+	for _, name := range sourceNames {
+		if err := evaluate(sourceRules(primaries, name), insts[name], false); err != nil {
+			return nil, nil, err
+		}
+	}
+	if active := activeFallbacks(fallbacks, primaries, skips); len(active) > 0 {
+		if err := evaluate(active, []Instance{{}}, true); err != nil {
+			return nil, nil, err
+		}
+	}
+	return domains, skips, nil
+}
+
+// aggregate adds recs to the record sets of the aggregate rule, by type and
+// name, in sets. It returns the records not already in their set, and gives
+// each set the lowest TTL of its records.
+func aggregate(sets map[*NameRule]map[string][]*models.RecordConfig, rule *NameRule, recs []*models.RecordConfig) []*models.RecordConfig {
+	if sets[rule] == nil {
+		sets[rule] = map[string][]*models.RecordConfig{}
+	}
+	added := []*models.RecordConfig{}
+	for _, rec := range recs {
+		key := rec.Type + " " + rec.NameFQDN
+		set := sets[rule][key]
+		dup := false
+		for _, r := range set {
+			if r.Target == rec.Target && r.MxPreference == rec.MxPreference && r.SrvPort == rec.SrvPort &&
+				r.SrvPriority == rec.SrvPriority && r.SrvWeight == rec.SrvWeight {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		set = append(set, rec)
+		ttl := rec.TTL
+		for _, r := range set {
+			if r.TTL < ttl {
+				ttl = r.TTL
+			}
+		}
+		for _, r := range set {
+			r.TTL = ttl
+		}
+		sets[rule][key] = set
+		added = append(added, rec)
+	}
+	return added
+}
+
+// zoneSuffixes are extra public suffixes, such as private TLDs like
+// internal, that zones are derived under in addition to the public suffix
+// list.
+var zoneSuffixes = splitList(os.Getenv("ZONE_SUFFIXES"))
+
+// splitList splits a comma separated list, dropping empty entries and
+// trailing dots.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.ToLower(strings.Trim(strings.TrimSpace(v), ".")); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// registrableDomain returns the suffix plus one label fqdn falls under,
+// preferring the longest matching entry of zoneSuffixes over the public
+// suffix list.
+func registrableDomain(fqdn string) (string, error) {
+	best := ""
+	for _, suffix := range zoneSuffixes {
+		if strings.HasSuffix(fqdn, "."+suffix) && len(suffix) > len(best) {
+			best = suffix
+		}
+	}
+	if best == "" {
+		return publicsuffix.EffectiveTLDPlusOne(fqdn)
+	}
+	rest := strings.TrimSuffix(fqdn, "."+best)
+	return rest[strings.LastIndex(rest, ".")+1:] + "." + best, nil
+}
+
+// canonicalName returns name in lower case without its trailing dot.
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// zoneFor returns the zone fqdn belongs in: the rule's zone= if it has one,
+// otherwise the registrable domain.
+func zoneFor(rule *NameRule, fqdn string) (string, error) {
+	fqdn = canonicalName(fqdn)
+	if rule.Zone == "" {
+		return registrableDomain(fqdn)
+	}
+	if fqdn != rule.Zone && !strings.HasSuffix(fqdn, "."+rule.Zone) {
+		return "", fmt.Errorf("not in zone %s", rule.Zone)
+	}
+	return rule.Zone, nil
+}
+
+// zoneProvider returns the name of the provider that manages dc.
+func zoneProvider(dc *models.DomainConfig) string {
+	for name := range dc.DNSProviders {
+		return name
+	}
+	return defaultProvider
+}
+
+// applyCorrection runs c, giving up after correctionTimeout or when ctx is
+// done. Corrections take no context, so a call that times out is abandoned
+// rather than cancelled.
+func applyCorrection(ctx context.Context, c *models.Correction) error {
+	if c.F == nil {
+		// Informational, with nothing to run.
+		return nil
+	}
+	return retryIf(ctx, c.Msg, func(err error) (bool, time.Duration) {
+		return correctionRetryable(c, err)
+	}, func() error {
+		done := make(chan error, 1)
+		go func() {
+			done <- c.F()
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(correctionTimeout):
+			return fmt.Errorf("%w after %s", errCorrectionTimeout, correctionTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// correctionRetryable reports whether c, having failed with err, may be
+// attempted again. A deletion may, as repeating one is harmless. A create
+// or modify is retried only when the API answered with a 429 or 5xx
+// status; after a network failure it may have gone through unseen. An
+// attempt that timed out may still be running, so it's never retried.
+func correctionRetryable(c *models.Correction, err error) (bool, time.Duration) {
+	if errors.Is(err, errCorrectionTimeout) {
+		return false, 0
+	}
+	if isDelete(c) {
+		return transient(err)
+	}
+	return retryableStatus(err)
+}
+
+// syncInterval is how long to wait between syncs. It is never allowed below
+// minSyncInterval, so a typo can't hammer a shared account's API.
+var (
+	syncInterval    = envDuration("SYNC_INTERVAL", 30*time.Second)
+	minSyncInterval = envDuration("MIN_SYNC_INTERVAL", 10*time.Second)
+)
+
+// runInterval returns how long Run waits between syncs for c, raised to
+// minSyncInterval.
+func runInterval(c Config) time.Duration {
+	d := syncInterval
+	if c.Interval > 0 {
+		d = c.Interval
+	}
+	if d < minSyncInterval {
+		return minSyncInterval
+	}
+	return d
+}
+
+// heartbeatInterval, when set, is how often Run logs a summary of the syncs
+// since the last one, so a quiet loop can be told apart from a stuck one.
+var heartbeatInterval = envDuration("HEARTBEAT_INTERVAL", 0)
+
+// heartbeat counts the syncs since the last heartbeat log.
+type heartbeat struct {
+	since   time.Time
+	syncs   int
+	failed  int
+	changes int
+}
+
+// record counts a sync that ended with sum and err, logging a heartbeat
+// when one is due.
+func (h *heartbeat) record(sum Summary, err error) {
+	if heartbeatInterval <= 0 {
+		return
+	}
+	h.syncs++
+	if err != nil {
+		h.failed++
+	}
+	h.changes += len(sum.Applied)
+	if time.Since(h.since) < heartbeatInterval {
+		return
+	}
+	slog.Info("Heartbeat", "syncs", h.syncs, "failed", h.failed, "period", time.Since(h.since).Round(time.Second), "droplets", sum.Droplets, "zones", sum.Zones, "changes", h.changes)
+	*h = heartbeat{since: time.Now()}
+}
+
+// runTimeout bounds a whole sync cycle. Zero means no limit.
+var runTimeout = envDuration("RUN_TIMEOUT", 0)
+
+// runMu is held for the duration of a sync, so a sync is never started while
+// another is still running.
+var runMu sync.Mutex
+
+// ErrSyncRunning is returned by Sync when a sync is already in progress.
+var ErrSyncRunning = errors.New("Previous sync is still running")
+
+// stateLoaded is set once STATE_FILE has been read, by the first Sync.
+var stateLoaded bool
+
+// Sync makes one pass over the droplets, computing the records the rules
+// produce and applying the corrections each zone needs, or, depending on c,
+// planning or exporting them instead.
+func Sync(ctx context.Context, c Config) (Summary, error) {
+	if !runMu.TryLock() {
+		return Summary{}, ErrSyncRunning
+	}
+	defer runMu.Unlock()
+	if err := configure(c); err != nil {
+		return Summary{}, err
+	}
+	if token == "" && refreshToken == "" {
+		return Summary{}, categorize(ErrConfig, errors.New("No DigitalOcean token: set Config.Token, DO_TOKEN or DO_REFRESH_TOKEN"))
+	}
+	if !stateLoaded {
+		if err := loadManagedZones(); err != nil {
+			return Summary{}, categorize(ErrConfig, fmt.Errorf("Error loading %s: %s", stateFile, err))
+		}
+		if err := loadOwnedRecords(); err != nil {
+			return Summary{}, categorize(ErrConfig, fmt.Errorf("Error loading %s: %s", ownedFile, err))
+		}
+		stateLoaded = true
+	}
+	if c.Reconcile {
+		slog.Warn("Reconciling, so this sync deletes every record the config doesn't produce, ignoring NO_DELETE, REPORT_DELETES, append-only zones and deletion caps")
+	}
+	if runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, runTimeout)
+		defer cancel()
+	}
+	var sum Summary
+	start := time.Now()
+	err := runOnce(ctx, &sum)
+	observeSync(start, sum, err)
+	writeRunReport(start, sum, err)
+	return sum, err
+}
+
+// Run syncs every SYNC_INTERVAL, plus up to SYNC_JITTER, until ctx is
+// done, or sooner when TriggerSync is called, on SIGHUP and when the config
+// file changes. A failed sync is logged and the next one goes ahead as
+// usual, except that a config that failed to load isn't retried until it
+// changes.
+func Run(ctx context.Context, c Config) error {
+	interval := runInterval(c)
+	requested := syncInterval
+	if c.Interval > 0 {
+		requested = c.Interval
+	}
+	if requested != interval {
+		slog.Warn("Sync interval is below the minimum; using the minimum", "interval", requested, "min", minSyncInterval)
+	}
+	// badConfig holds the modification time of a config file that failed
+	// to load, so it isn't retried until it changes.
+	var badConfig time.Time
+	beat := heartbeat{since: time.Now()}
+	// Resolve namesCfg for watchConfig before the first sync.
+	if err := configure(c); err != nil {
+		return err
+	}
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	defer stopWatching()
+	go watchConfig(watchCtx)
+	for {
+		if !badConfig.IsZero() && configModTime().Equal(badConfig) {
+			if err := waitForSync(ctx, time.Now(), interval); err != nil {
+				return err
+			}
+			continue
+		}
+		badConfig = time.Time{}
+		start := time.Now()
+		sum, err := Sync(ctx, c)
+		beat.record(sum, err)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Error("Error running dns sync", "error", err)
+			if errors.Is(err, ErrConfig) {
+				badConfig = configModTime()
+				if !badConfig.IsZero() {
+					slog.Info("Waiting for the config to change before retrying", "config", namesCfg)
+				}
+			}
+		}
+		// The config's sync options may set the interval.
+		interval = runInterval(cfg)
+		took := time.Now().Sub(start)
+		slog.Info("Synced records", "took", took)
+		if took > interval {
+			slog.Warn("Sync took longer than the interval", "took", took, "interval", interval)
+		}
+		if err := waitForSync(ctx, time.Now(), interval); err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for d, or returns early with ctx's error when it is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+const defaultProvider = "digitalocean"
+
+// providerTypes maps the provider names rules may select with provider=
+// to their dnscontrol provider types.
+var providerTypes = map[string]string{
+	"digitalocean": "DIGITALOCEAN",
+	"cloudflare":   "CLOUDFLAREAPI",
+	"route53":      "ROUTE53",
+}
+
+// providerFactories maps the provider names rules may select with
+// provider= to constructors for them. Each reads its credentials from the
+// environment.
+var providerFactories = map[string]func() (providers.DNSServiceProvider, error){
+	"digitalocean": func() (providers.DNSServiceProvider, error) {
+		countRequests()
+		t, err := tokenSource().Token()
+		if err != nil {
+			return nil, err
+		}
+		return digitalocean.NewDo(map[string]string{"token": t.AccessToken}, nil)
+	},
+	// Cloudflare takes a global API key and its account's email; the pinned
+	// dnscontrol predates API tokens.
+	"cloudflare": func() (providers.DNSServiceProvider, error) {
+		creds := map[string]string{
+			"apikey":  os.Getenv("CLOUDFLARE_API_KEY"),
+			"apiuser": os.Getenv("CLOUDFLARE_EMAIL"),
+		}
+		if creds["apikey"] == "" || creds["apiuser"] == "" {
+			return nil, fmt.Errorf("The cloudflare provider needs CLOUDFLARE_API_KEY and CLOUDFLARE_EMAIL")
+		}
+		return providers.CreateDNSProvider(providerTypes["cloudflare"], creds, nil)
+	},
+	// Route53 falls back to the default AWS credentials, like an instance
+	// role, when no keys are set.
+	"route53": func() (providers.DNSServiceProvider, error) {
+		return providers.CreateDNSProvider(providerTypes["route53"], map[string]string{
+			"KeyId":     os.Getenv("AWS_ACCESS_KEY_ID"),
+			"SecretKey": os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			"Token":     os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil)
+	},
+}
+
+// zoneSelected reports whether zone should be synced given Config.Zone.
+func zoneSelected(zone string) bool {
+	return cfg.Zone == "" || zone == canonicalName(cfg.Zone)
+}
@@ -0,0 +1,600 @@
+package dnssync
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+// createdAfter, when set, limits management to droplets created after it.
+// It is either an RFC3339 timestamp or a duration before the current time.
+var createdAfter = os.Getenv("CREATED_AFTER")
+
+// createdCutoff resolves createdAfter to a point in time, or the zero time
+// when it is unset.
+func createdCutoff() (time.Time, error) {
+	if createdAfter == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(createdAfter); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, createdAfter)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("CREATED_AFTER must be a duration or RFC3339 timestamp: %s", err)
+	}
+	return t, nil
+}
+
+// createdBefore reports whether drop was created before cutoff. Droplets
+// with an unparseable creation time are treated as old.
+func createdBefore(drop godo.Droplet, cutoff time.Time) bool {
+	created, err := time.Parse(time.RFC3339, drop.Created)
+	return err != nil || created.Before(cutoff)
+}
+
+// minDropletAge, when set, defers the records of droplets younger than it,
+// which may not have their addresses assigned yet, to a later sync.
+var minDropletAge = envDuration("MIN_DROPLET_AGE", 0)
+
+// matureDroplets returns the instances of drops at least minDropletAge old.
+// Instances their source gives no creation time are treated as old.
+func matureDroplets(drops []Instance) []Instance {
+	if minDropletAge <= 0 {
+		return drops
+	}
+	cutoff := time.Now().Add(-minDropletAge)
+	kept := make([]Instance, 0, len(drops))
+	var young []string
+	for _, drop := range drops {
+		if createdBefore(drop.Droplet, cutoff) {
+			kept = append(kept, drop)
+		} else {
+			young = append(young, drop.Name)
+		}
+	}
+	if len(young) > 0 {
+		slog.Info("Deferring droplets younger than MIN_DROPLET_AGE", "min_age", minDropletAge, "droplets", strings.Join(young, ","))
+	}
+	return kept
+}
+
+// DropletList lists all droplets, or only those carrying tag if it is set,
+// ordered by ID so that nothing depends on the order the API pages them in.
+// If fetching a page fails, the droplets from earlier pages are returned
+// along with the error.
+func DropletList(ctx context.Context, client *godo.Client, tag string) ([]godo.Droplet, error) {
+	list := []godo.Droplet{}
+	opt := &godo.ListOptions{}
+	var err error
+	for {
+		var droplets []godo.Droplet
+		var resp *godo.Response
+		err = withRetry(ctx, "listing droplets", func() error {
+			var err error
+			if tag != "" {
+				droplets, resp, err = client.Droplets.ListByTag(ctx, tag, opt)
+			} else {
+				droplets, resp, err = client.Droplets.List(ctx, opt)
+			}
+			return err
+		})
+		if err != nil {
+			break
+		}
+		list = append(list, droplets...)
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		var page int
+		if page, err = resp.Links.CurrentPage(); err != nil {
+			break
+		}
+		opt.Page = page + 1
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, err
+}
+
+// dropletAllowlist is an optional file or URL listing the droplets, by ID
+// or name, one per line, that may be managed. Any other droplet is ignored
+// whatever the listing returns.
+var dropletAllowlist = os.Getenv("DROPLET_ALLOWLIST")
+
+// allowedDroplets returns the instances of drops on dropletAllowlist, or all
+// of them when it is unset.
+func allowedDroplets(ctx context.Context, drops []Instance) ([]Instance, error) {
+	if dropletAllowlist == "" {
+		return drops, nil
+	}
+	var dat []byte
+	var err error
+	if isURL(dropletAllowlist) {
+		dat, err = fetchConfig(ctx, dropletAllowlist)
+	} else {
+		dat, err = ioutil.ReadFile(dropletAllowlist)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Reading DROPLET_ALLOWLIST: %w", err)
+	}
+	allowed := map[string]bool{}
+	for _, line := range strings.Split(string(dat), "\n") {
+		if line = strings.TrimSpace(line); line != "" && line[0] != '#' {
+			allowed[line] = true
+		}
+	}
+	kept := make([]Instance, 0, len(drops))
+	for _, drop := range drops {
+		if allowed[drop.Name] || drop.ID != 0 && allowed[strconv.Itoa(drop.ID)] {
+			kept = append(kept, drop)
+		}
+	}
+	return kept, nil
+}
+
+// allowPartialListing lets a sync go ahead with the droplets listed before
+// a listing failure. Deletions are held for that sync, since records for
+// droplets on the missing pages would otherwise be removed.
+var allowPartialListing = os.Getenv("ALLOW_PARTIAL_LISTING") != ""
+
+// commonTag returns the tag shared by every rule, if there is one, so the
+// droplet listing can be filtered server side. There is none when a rule
+// uses $DROPIP, whose droplet needn't have the tag.
+func commonTag(rules []*NameRule) string {
+	if tagIgnoreCase {
+		return ""
+	}
+	tag := ""
+	for i, rule := range rules {
+		if dropIPVar.MatchString(rule.FQDN + " " + rule.Target) {
+			return ""
+		}
+		if rule.Label == "" || isGlob(rule.Label) || strings.Contains(rule.Label, ",") || (i > 0 && rule.Label != tag) {
+			return ""
+		}
+		tag = rule.Label
+	}
+	return tag
+}
+
+// tagIgnoreCase makes tag matching ignore case and surrounding whitespace.
+var tagIgnoreCase = os.Getenv("TAG_IGNORE_CASE") != ""
+
+// hasTag reports whether drop has a tag matching pattern, which may be a
+// glob like env:prod-*.
+func hasTag(drop godo.Droplet, pattern string) bool {
+	_, ok := matchTag(drop, pattern)
+	return ok
+}
+
+// matchTag returns the first of drop's tags matching pattern.
+func matchTag(drop godo.Droplet, pattern string) (string, bool) {
+	if tagIgnoreCase {
+		pattern = strings.ToLower(pattern)
+	}
+	for _, t := range drop.Tags {
+		if tagIgnoreCase {
+			t = strings.ToLower(strings.TrimSpace(t))
+		}
+		if ok, _ := path.Match(pattern, t); ok {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+// matchLabel reports whether drop has a tag matching each of the
+// comma-separated patterns of label, like role:db,env:*, and returns the
+// $TAGPART of the first pattern with a glob.
+func matchLabel(drop godo.Droplet, label string) (string, bool) {
+	part, found := "", false
+	for _, pattern := range strings.Split(label, ",") {
+		tag, ok := matchTag(drop, pattern)
+		if !ok {
+			return "", false
+		}
+		if !found && isGlob(pattern) {
+			part, found = tagPart(pattern, tag), true
+		}
+	}
+	return part, true
+}
+
+// tagPart returns the part of tag matched by the glob in pattern, with the
+// literal text before and after it removed: team/* gives payments for the
+// tag team/payments. It is empty when pattern has no glob.
+func tagPart(pattern, tag string) string {
+	if tagIgnoreCase {
+		pattern = strings.ToLower(pattern)
+	}
+	start := strings.IndexAny(pattern, "*?[\\")
+	if start < 0 {
+		return ""
+	}
+	end := strings.LastIndexAny(pattern, "*?]")
+	prefix, suffix := pattern[:start], pattern[end+1:]
+	if len(prefix)+len(suffix) > len(tag) {
+		return ""
+	}
+	return tag[len(prefix) : len(tag)-len(suffix)]
+}
+
+// hasFeature reports whether drop has feature, like ipv6, enabled.
+func hasFeature(drop godo.Droplet, feature string) bool {
+	for _, f := range drop.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// strictIPv6 warns on every sync that has AAAA rules for public IPv6
+// addresses but no droplet with one, as when IPv6 isn't enabled on the
+// droplets, since those rules then silently produce nothing.
+var strictIPv6 = os.Getenv("STRICT_IPV6") != ""
+
+// checkIPv6 warns, under STRICT_IPV6, if rules need $PUB6 but none of drops
+// has a public IPv6 address.
+func checkIPv6(rules []*NameRule, drops []Instance) {
+	if !strictIPv6 {
+		return
+	}
+	var needed []string
+	for _, rule := range rules {
+		if rule.Type == "AAAA" && rule.Fallback == "" && strings.Contains(rule.Target, "$PUB6") {
+			needed = append(needed, ruleName(rule))
+		}
+	}
+	if len(needed) == 0 {
+		return
+	}
+	for _, drop := range drops {
+		if ip, _ := drop.PublicIPv6(); ip != "" {
+			return
+		}
+	}
+	slog.Warn("No droplet has a public IPv6 address, so AAAA rules produce no records; is IPv6 enabled on them?", "droplets", len(drops), "rules", strings.Join(needed, ","))
+}
+
+// srvWeight returns the SRV weight rule gives drop.
+func srvWeight(rule *NameRule, drop godo.Droplet) uint16 {
+	n := 0
+	switch {
+	case rule.WeightFrom == "vcpus":
+		n = drop.Vcpus
+	case rule.WeightFrom == "memory":
+		n = drop.Memory / 1024
+	case strings.HasPrefix(rule.WeightFrom, "tag:"):
+		prefix := rule.WeightFrom[len("tag:"):]
+		for _, t := range drop.Tags {
+			if v := strings.TrimPrefix(t, prefix); v != t {
+				if n, _ = strconv.Atoi(v); n > 0 {
+					break
+				}
+			}
+		}
+	}
+	if n <= 0 {
+		return rule.SrvWeight
+	}
+	if n > 65535 {
+		n = 65535
+	}
+	return uint16(n)
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[\\")
+}
+
+// duplicateNames picks how droplets sharing a name are handled: "first"
+// keeps only the one with the lowest ID, "region" appends the region slug to
+// each of their names.
+var duplicateNames = envOr("DUPLICATE_NAMES", "first")
+
+// resolveDuplicates handles instances of a source with the same name, which
+// would otherwise produce conflicting records depending on listing order.
+func resolveDuplicates(drops []Instance) ([]Instance, error) {
+	if duplicateNames != "first" && duplicateNames != "region" {
+		return nil, fmt.Errorf("DUPLICATE_NAMES must be 'first' or 'region', not '%s'", duplicateNames)
+	}
+	byName := map[[2]string][]int{}
+	for i, drop := range drops {
+		key := [2]string{drop.Source, drop.Name}
+		byName[key] = append(byName[key], i)
+	}
+	skip := map[int]bool{}
+	for key, idx := range byName {
+		name := key[1]
+		if len(idx) < 2 {
+			continue
+		}
+		if duplicateNames == "region" {
+			for _, i := range idx {
+				if drops[i].Region != nil {
+					drops[i].Name = name + "-" + drops[i].Region.Slug
+				}
+			}
+			slog.Info("Duplicate droplet names; appending their regions", "name", name, "droplets", len(idx))
+			continue
+		}
+		keep := idx[0]
+		for _, i := range idx[1:] {
+			if drops[i].ID < drops[keep].ID {
+				keep = i
+			}
+		}
+		for _, i := range idx {
+			if i != keep {
+				skip[i] = true
+			}
+		}
+		slog.Info("Duplicate droplet names; using only the oldest droplet", "name", name, "droplets", len(idx), "id", drops[keep].ID)
+	}
+	kept := make([]Instance, 0, len(drops))
+	for i, drop := range drops {
+		if !skip[i] {
+			kept = append(kept, drop)
+		}
+	}
+	return kept, nil
+}
+
+// dropletShrinkPercent is how far the droplet count may fall below the last
+// accepted count before deletions are held back. Zero disables the check.
+var dropletShrinkPercent = envInt("DROPLET_SHRINK_PERCENT", 50)
+
+// lastDropletCount is the last accepted droplet count, the baseline
+// dropletsShrank compares against. It is saved in STATE_FILE, so the check
+// also holds for the first sync after a restart.
+var lastDropletCount int
+
+// dropletsShrank reports whether n droplets is more than
+// dropletShrinkPercent fewer than the last accepted count, or none at all,
+// which more likely means a bad listing than a fleet that really shrank.
+// Otherwise n becomes the new baseline. A held count doesn't, so deletions
+// stay held until the count recovers or a -reconcile sync accepts it.
+func dropletsShrank(n int) bool {
+	zoneStateMu.Lock()
+	defer zoneStateMu.Unlock()
+	prev := lastDropletCount
+	if dropletShrinkPercent > 0 && prev > 0 && !cfg.Reconcile {
+		if drop := (prev - n) * 100 / prev; n == 0 || drop > dropletShrinkPercent {
+			slog.Warn("Droplet count fell; holding deletions", "from", prev, "to", n, "percent", drop)
+			return true
+		}
+	}
+	if n != prev {
+		lastDropletCount = n
+		if err := saveManagedZones(); err != nil {
+			slog.Error("Error saving state", "file", stateFile, "error", err)
+		}
+	}
+	return false
+}
+
+// canaryPercent, when set, rolls out the records of droplets that appear
+// between syncs in stages: this percentage of them is synced right away,
+// and the rest once canaryPeriod has passed. Droplets that appear while a
+// canary is waiting join its second stage. The droplets of the first sync
+// are all synced at once.
+var (
+	canaryPercent = envInt("CANARY_PERCENT", 0)
+	canaryPeriod  = envDuration("CANARY_PERIOD", 10*time.Minute)
+)
+
+var (
+	// promoted holds the keys of the instances whose records are synced.
+	// It is nil before the first sync.
+	promoted map[string]bool
+	// canaryStarted is when the waiting canary's first stage was synced.
+	canaryStarted time.Time
+)
+
+// canaryDroplets returns the instances of drops whose records may be synced
+// under CANARY_PERCENT, promoting new ones as their stage comes up.
+func canaryDroplets(drops []Instance) []Instance {
+	if canaryPercent <= 0 || canaryPercent >= 100 {
+		return drops
+	}
+	first := promoted == nil
+	seen := map[string]bool{}
+	var pending []Instance
+	for _, drop := range drops {
+		if first || promoted[drop.Key()] {
+			seen[drop.Key()] = true
+		} else {
+			pending = append(pending, drop)
+		}
+	}
+	// Droplets that are gone are forgotten.
+	promoted = seen
+	switch {
+	case len(pending) == 0:
+		canaryStarted = time.Time{}
+		return drops
+	case canaryStarted.IsZero():
+		n := (len(pending)*canaryPercent + 99) / 100
+		for _, drop := range pending[:n] {
+			promoted[drop.Key()] = true
+		}
+		canaryStarted = time.Now()
+		slog.Info("Canary: syncing some new droplets, the rest after the canary period", "syncing", n, "new", len(pending), "period", canaryPeriod)
+	case time.Since(canaryStarted) >= canaryPeriod:
+		for _, drop := range pending {
+			promoted[drop.Key()] = true
+		}
+		canaryStarted = time.Time{}
+		slog.Info("Canary: syncing the remaining new droplets", "new", len(pending))
+		return drops
+	}
+	kept := []Instance{}
+	for _, drop := range drops {
+		if promoted[drop.Key()] {
+			kept = append(kept, drop)
+		}
+	}
+	return kept
+}
+
+// vpcCache looks up VPC address ranges, fetching each at most once per sync.
+type vpcCache struct {
+	ctx    context.Context
+	client *godo.Client
+	ranges map[string]*net.IPNet
+}
+
+func (v *vpcCache) ipRange(uuid string) (*net.IPNet, error) {
+	if r, ok := v.ranges[uuid]; ok {
+		return r, nil
+	}
+	if v.client == nil {
+		return nil, fmt.Errorf("Looking up VPC %s needs API access", uuid)
+	}
+	vpc, _, err := v.client.VPCs.Get(v.ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	_, r, err := net.ParseCIDR(vpc.IPRange)
+	if err != nil {
+		return nil, fmt.Errorf("VPC %s has bad IP range '%s': %s", uuid, vpc.IPRange, err)
+	}
+	v.ranges[uuid] = r
+	return r, nil
+}
+
+// floatingCache maps droplet IDs to their floating IPs, listed at most once
+// per sync and only if a rule uses $FLOAT.
+type floatingCache struct {
+	ctx    context.Context
+	client *godo.Client
+	ips    map[int]string
+}
+
+// ip returns the floating IP assigned to drop, or "" if it has none.
+func (f *floatingCache) ip(drop godo.Droplet) (string, error) {
+	if f.ips == nil {
+		if f.client == nil {
+			return "", fmt.Errorf("Looking up floating IPs needs API access")
+		}
+		ips := map[int]string{}
+		opt := &godo.ListOptions{}
+		for {
+			list, resp, err := f.client.FloatingIPs.List(f.ctx, opt)
+			if err != nil {
+				return "", err
+			}
+			for _, fip := range list {
+				if fip.Droplet != nil {
+					ips[fip.Droplet.ID] = fip.IP
+				}
+			}
+			if resp.Links == nil || resp.Links.IsLastPage() {
+				break
+			}
+			page, err := resp.Links.CurrentPage()
+			if err != nil {
+				return "", err
+			}
+			opt.Page = page + 1
+		}
+		f.ips = ips
+	}
+	return f.ips[drop.ID], nil
+}
+
+// ipv4In returns drop's first IPv4 address of the given network type
+// ("public" or "private") inside cidr, if any.
+func ipv4In(drop godo.Droplet, typ string, cidr *net.IPNet) string {
+	if drop.Networks == nil {
+		return ""
+	}
+	for _, n := range drop.Networks.V4 {
+		if n.Type == typ && cidr.Contains(net.ParseIP(n.IPAddress)) {
+			return n.IPAddress
+		}
+	}
+	return ""
+}
+
+// projectCache looks up the droplets in each project, fetching each project
+// at most once per sync.
+type projectCache struct {
+	ctx     context.Context
+	client  *godo.Client
+	members map[string]map[string]bool
+}
+
+// contains reports whether drop is in the project with this name or ID.
+func (p *projectCache) contains(project string, drop godo.Droplet) (bool, error) {
+	urns, ok := p.members[project]
+	if !ok {
+		var err error
+		if urns, err = p.fetch(project); err != nil {
+			return false, err
+		}
+		p.members[project] = urns
+	}
+	return urns[drop.URN()], nil
+}
+
+func (p *projectCache) fetch(project string) (map[string]bool, error) {
+	if p.client == nil {
+		return nil, fmt.Errorf("Looking up project %s needs API access", project)
+	}
+	id := ""
+	opt := &godo.ListOptions{}
+	for id == "" {
+		projects, resp, err := p.client.Projects.List(p.ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, pr := range projects {
+			if pr.Name == project || pr.ID == project {
+				id = pr.ID
+			}
+		}
+		if id != "" || resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opt.Page = page + 1
+	}
+	if id == "" {
+		return nil, fmt.Errorf("No project named %s", project)
+	}
+	urns := map[string]bool{}
+	opt = &godo.ListOptions{}
+	for {
+		resources, resp, err := p.client.Projects.ListResources(p.ctx, id, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resources {
+			urns[r.URN] = true
+		}
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opt.Page = page + 1
+	}
+	return urns, nil
+}
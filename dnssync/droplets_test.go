@@ -0,0 +1,84 @@
+package dnssync
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDropletsShrank(t *testing.T) {
+	defer func(n int) { lastDropletCount = n }(lastDropletCount)
+	lastDropletCount = 0
+	steps := []struct {
+		n    int
+		hold bool
+	}{
+		{10, false}, // first count is the baseline
+		{0, true},
+		{0, true}, // still held, the baseline stays 10
+		{4, true},
+		{6, false},
+		{3, false}, // 50% of 6 is allowed
+		{0, true},
+	}
+	for i, s := range steps {
+		if got := dropletsShrank(s.n); got != s.hold {
+			t.Errorf("step %d: dropletsShrank(%d) = %v, want %v", i, s.n, got, s.hold)
+		}
+	}
+}
+
+func TestDropletBaselinePersists(t *testing.T) {
+	defer func(f string, n int, z map[string]string) {
+		stateFile, lastDropletCount, managedZones = f, n, z
+	}(stateFile, lastDropletCount, managedZones)
+	stateFile = filepath.Join(t.TempDir(), "state.json")
+	lastDropletCount, managedZones = 0, map[string]string{"ssdv.win": "DIGITALOCEAN"}
+	dropletsShrank(10)
+	lastDropletCount, managedZones = 0, map[string]string{}
+	if err := loadManagedZones(); err != nil {
+		t.Fatal(err)
+	}
+	if lastDropletCount != 10 || managedZones["ssdv.win"] != "DIGITALOCEAN" {
+		t.Fatalf("loaded count %d and zones %v", lastDropletCount, managedZones)
+	}
+	if !dropletsShrank(0) {
+		t.Error("an empty listing after a restart didn't hold deletions")
+	}
+}
+
+func TestLoadOldStateFile(t *testing.T) {
+	defer func(f string, z map[string]string) { stateFile, managedZones = f, z }(stateFile, managedZones)
+	stateFile = filepath.Join(t.TempDir(), "state.json")
+	if err := ioutil.WriteFile(stateFile, []byte(`{"ssdv.win": "DIGITALOCEAN"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	managedZones = map[string]string{}
+	if err := loadManagedZones(); err != nil {
+		t.Fatal(err)
+	}
+	if managedZones["ssdv.win"] != "DIGITALOCEAN" {
+		t.Fatalf("zones %v", managedZones)
+	}
+}
+
+func TestCommonTag(t *testing.T) {
+	tests := []struct {
+		cfg, want string
+	}{
+		{"A $DROP.ssdv.win $PUB4 [app]\nA $DROP.pvt.ssdv.win $PRI4 [app]\n", "app"},
+		{"A $DROP.ssdv.win $PUB4 [app]\nA $DROP.pvt.ssdv.win $PRI4 [db]\n", ""},
+		{"A $DROP.ssdv.win $PUB4 [app]\nA $DROP.pvt.ssdv.win $PRI4\n", ""},
+		// The gateway needn't be tagged app, so it must still be listed.
+		{"A $DROP.ssdv.win $PUB4 [app]\nA $DROP.egress.ssdv.win $DROPIP:gateway [app]\n", ""},
+	}
+	for _, tt := range tests {
+		rules, _, err := parseRules("t.cfg", []byte(tt.cfg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := commonTag(rules); got != tt.want {
+			t.Errorf("commonTag(%q) = %q, want %q", tt.cfg, got, tt.want)
+		}
+	}
+}
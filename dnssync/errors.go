@@ -0,0 +1,153 @@
+package dnssync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+// Error categories returned by Sync, checked with errors.Is.
+var (
+	ErrConfig   = errors.New("config error")
+	ErrProvider = errors.New("provider error")
+	ErrListing  = errors.New("droplet listing error")
+)
+
+// isConflict reports whether err is the API refusing a write because the
+// record changed underneath it. Only DigitalOcean's typed responses are
+// classified; other errors are never a conflict.
+func isConflict(err error) bool {
+	var resp *godo.ErrorResponse
+	return errors.As(err, &resp) && resp.Response != nil && resp.Response.StatusCode == http.StatusConflict
+}
+
+// apiRetries is how many times a DigitalOcean API call that failed with a
+// rate limit or a server error is retried, waiting retryBackoff, doubled
+// for each retry, or as long as the response asks. Writes other than
+// deletions are retried only when the response said 429 or 5xx.
+var (
+	apiRetries   = envInt("API_RETRIES", 3)
+	retryBackoff = envDuration("RETRY_BACKOFF", time.Second)
+)
+
+// transient reports whether err is worth retrying: a rate limit, a server
+// error or a network failure. The wait is what the response asked for with
+// Retry-After or RateLimit-Reset, or zero.
+func transient(err error) (bool, time.Duration) {
+	if retry, wait := retryableStatus(err); retry {
+		return true, wait
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr), 0
+}
+
+// retryableStatus reports whether err is a response with a rate limit or
+// server error status, and how long the response asked to wait. Errors
+// without a status, like network failures, are not.
+func retryableStatus(err error) (bool, time.Duration) {
+	var resp *godo.ErrorResponse
+	if !errors.As(err, &resp) || resp.Response == nil {
+		return false, 0
+	}
+	if code := resp.Response.StatusCode; code != http.StatusTooManyRequests && code < 500 {
+		return false, 0
+	}
+	return true, retryAfter(resp.Response.Header)
+}
+
+// rateLimited reports whether err is a rate limit response, which refused
+// the request without running it, and how long the response asked to wait.
+func rateLimited(err error) (bool, time.Duration) {
+	var resp *godo.ErrorResponse
+	if !errors.As(err, &resp) || resp.Response == nil || resp.Response.StatusCode != http.StatusTooManyRequests {
+		return false, 0
+	}
+	return true, retryAfter(resp.Response.Header)
+}
+
+// retryAfter returns how long h asks a client to wait before retrying.
+func retryAfter(h http.Header) time.Duration {
+	if s, err := strconv.Atoi(h.Get("Retry-After")); err == nil {
+		return time.Duration(s) * time.Second
+	}
+	if reset, err := strconv.ParseInt(h.Get("RateLimit-Reset"), 10, 64); err == nil {
+		if d := time.Until(time.Unix(reset, 0)); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// withRetry runs f, retrying it up to apiRetries times while it fails with
+// transient errors. It is for calls that are safe to repeat, like listings.
+func withRetry(ctx context.Context, what string, f func() error) error {
+	return retryIf(ctx, what, transient, f)
+}
+
+// retryIf runs f, retrying it up to apiRetries times while retryable says
+// its error is worth retrying.
+func retryIf(ctx context.Context, what string, retryable func(error) (bool, time.Duration), f func() error) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > apiRetries {
+			return err
+		}
+		retry, wait := retryable(err)
+		if !retry {
+			return err
+		}
+		if wait < backoff {
+			wait = backoff
+		}
+		slog.Warn("Retrying "+what, "wait", wait, "retry", attempt, "retries", apiRetries, "error", err)
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// apiRateLimit, when set, is the most DigitalOcean API requests per second
+// all syncs make together. Each request, including every page of the
+// listing behind GetDomainCorrections, is spread out to stay under it;
+// other providers' requests aren't limited.
+var apiRateLimit = envInt("API_RATE_LIMIT", 0)
+
+var (
+	throttleMu sync.Mutex
+	// nextCall is the earliest time the next request may start.
+	nextCall time.Time
+)
+
+// throttle waits for the next request allowed by apiRateLimit, or returns
+// ctx's error when it is done first.
+func throttle(ctx context.Context) error {
+	if apiRateLimit <= 0 {
+		return nil
+	}
+	throttleMu.Lock()
+	at := time.Now()
+	if nextCall.After(at) {
+		at = nextCall
+	}
+	nextCall = at.Add(time.Second / time.Duration(apiRateLimit))
+	throttleMu.Unlock()
+	return sleep(ctx, time.Until(at))
+}
+
+// categorize tags err with one of the error categories above.
+func categorize(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", kind, err)
+}
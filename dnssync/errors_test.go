@@ -0,0 +1,91 @@
+package dnssync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/StackExchange/dnscontrol/models"
+	"github.com/digitalocean/godo"
+)
+
+func apiError(code int) error {
+	return &godo.ErrorResponse{Response: &http.Response{StatusCode: code, Request: &http.Request{}}}
+}
+
+func TestIsConflict(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{apiError(http.StatusConflict), true},
+		{fmt.Errorf("applying: %w", apiError(http.StatusConflict)), true},
+		{apiError(http.StatusInternalServerError), false},
+		{errors.New("409 conflict"), false},
+		{errors.New("record conflicts with an existing CNAME"), false},
+	}
+	for _, tt := range tests {
+		if got := isConflict(tt.err); got != tt.want {
+			t.Errorf("isConflict(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestApplyCorrectionRetries(t *testing.T) {
+	defer func(n int, b time.Duration) { apiRetries, retryBackoff = n, b }(apiRetries, retryBackoff)
+	apiRetries, retryBackoff = 2, time.Millisecond
+	tests := []struct {
+		msg   string
+		err   error
+		calls int
+	}{
+		{"CREATE A web.ssdv.win 1.2.3.4 ttl=100", apiError(http.StatusInternalServerError), 3},
+		{"MODIFY A web.ssdv.win: (1.2.3.4 ttl=100) -> (1.2.3.5 ttl=100)", apiError(http.StatusBadGateway), 3},
+		{"CREATE A web.ssdv.win 1.2.3.4 ttl=100", apiError(http.StatusTooManyRequests), 3},
+		{"CREATE A web.ssdv.win 1.2.3.4 ttl=100", apiError(http.StatusUnprocessableEntity), 1},
+		{"CREATE A web.ssdv.win 1.2.3.4 ttl=100", errors.New("429 rate limit exceeded"), 1},
+		{"CREATE A web.ssdv.win 1.2.3.4 ttl=100", &net.OpError{Op: "read", Err: errors.New("connection reset")}, 1},
+		{"DELETE A web.ssdv.win 1.2.3.4 ttl=100", apiError(http.StatusInternalServerError), 3},
+		{"DELETE A web.ssdv.win 1.2.3.4 ttl=100", &net.OpError{Op: "read", Err: errors.New("connection reset")}, 3},
+		{"DELETE A web.ssdv.win 1.2.3.4 ttl=100", errors.New("503 service unavailable"), 1},
+		{"DELETE A web.ssdv.win 1.2.3.4 ttl=100", apiError(http.StatusNotFound), 1},
+	}
+	for _, tt := range tests {
+		calls := 0
+		c := &models.Correction{Msg: tt.msg, F: func() error {
+			calls++
+			return tt.err
+		}}
+		if err := applyCorrection(context.Background(), c); err == nil {
+			t.Errorf("%s: no error", tt.msg)
+		}
+		if calls != tt.calls {
+			t.Errorf("%s failing with %s: %d calls, want %d", tt.msg, tt.err, calls, tt.calls)
+		}
+	}
+}
+
+func TestApplyCorrectionTimeoutNotRetried(t *testing.T) {
+	defer func(n int, b, d time.Duration) { apiRetries, retryBackoff, correctionTimeout = n, b, d }(apiRetries, retryBackoff, correctionTimeout)
+	apiRetries, retryBackoff, correctionTimeout = 2, time.Millisecond, 10*time.Millisecond
+	var calls int32
+	release := make(chan struct{})
+	defer close(release)
+	c := &models.Correction{Msg: "DELETE A web.ssdv.win 1.2.3.4 ttl=100", F: func() error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil
+	}}
+	err := applyCorrection(context.Background(), c)
+	if !errors.Is(err, errCorrectionTimeout) {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("%d attempts started, want 1", n)
+	}
+}
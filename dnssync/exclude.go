@@ -0,0 +1,110 @@
+package dnssync
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/digitalocean/godo"
+)
+
+// dropletFilter matches the droplets of an exclude line: those carrying its
+// tags and whose names match its regex, whichever it has.
+type dropletFilter struct {
+	Label string
+	Regex *regexp.Regexp
+}
+
+// matches reports whether drop matches f.
+func (f dropletFilter) matches(drop godo.Droplet) bool {
+	if f.Label != "" {
+		if _, ok := matchLabel(drop, f.Label); !ok {
+			return false
+		}
+	}
+	return f.Regex == nil || f.Regex.MatchString(drop.Name)
+}
+
+// String returns f as the parts of an exclude line.
+func (f dropletFilter) String() string {
+	parts := []string{}
+	if f.Label != "" {
+		parts = append(parts, "["+f.Label+"]")
+	}
+	if f.Regex != nil {
+		parts = append(parts, "`"+f.Regex.String()+"`")
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseExcludeLine parses an "exclude [ci] `^runner-`" line, which keeps
+// every rule from producing records for the droplets it matches.
+func parseExcludeLine(parts []string, zones *zoneSettings) error {
+	if len(parts) < 2 {
+		return fmt.Errorf("Exclude line needs at least 'exclude [$TAGS]' or 'exclude `$REGEX`'")
+	}
+	var f dropletFilter
+	for _, part := range parts[1:] {
+		if label := strings.TrimSuffix(strings.TrimPrefix(part, "["), "]"); label != part {
+			// Tag patterns are checked as a rule's are.
+			check := &NameRule{}
+			if err := check.setOption("tag", label); err != nil {
+				return err
+			}
+			f.Label = label
+		} else if rex := strings.Trim(part, "`"); rex != part {
+			re, err := regexp.Compile(rex)
+			if err != nil {
+				return fmt.Errorf("Bad exclude regex '%s': %s", part, err)
+			}
+			f.Regex = re
+		} else {
+			return fmt.Errorf("Unexpected exclude part '%s'", part)
+		}
+	}
+	zones.Excluded = append(zones.Excluded, f)
+	return nil
+}
+
+// parseIgnoreLine parses an "ignore vpn.ssdv.win *.manual.ssdv.win" line of
+// names, or globs of names, to leave alone. A * matches any run of
+// characters, dots included.
+func parseIgnoreLine(parts []string, zones *zoneSettings) error {
+	if len(parts) < 2 {
+		return fmt.Errorf("Ignore line needs at least 'ignore $NAME'")
+	}
+	for _, name := range parts[1:] {
+		name = canonicalName(name)
+		if _, err := path.Match(name, ""); err != nil {
+			return fmt.Errorf("Bad ignore pattern '%s': %s", name, err)
+		}
+		zones.Ignored = append(zones.Ignored, name)
+	}
+	return nil
+}
+
+// excluded reports whether drop matches an exclude line.
+func (z *zoneSettings) excluded(drop godo.Droplet) bool {
+	for _, f := range z.Excluded {
+		if f.matches(drop) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignored reports whether name matches an ignore line. The ownership record
+// of an ignored name is ignored with it.
+func (z *zoneSettings) ignored(name string) bool {
+	name = canonicalName(name)
+	if txtOwnerID != "" {
+		name = ownedName(name)
+	}
+	for _, pattern := range z.Ignored {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package dnssync
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/godo"
+)
+
+func TestIgnored(t *testing.T) {
+	z := newZoneSettings()
+	if err := parseIgnoreLine([]string{"ignore", "vpn.ssdv.win", "*.manual.ssdv.win"}, z); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"vpn.ssdv.win", true},
+		{"VPN.ssdv.win.", true},
+		{"a.manual.ssdv.win", true},
+		// * crosses dots.
+		{"a.b.manual.ssdv.win", true},
+		{"manual.ssdv.win", false},
+		{"web.ssdv.win", false},
+	}
+	for _, tt := range tests {
+		if got := z.ignored(tt.name); got != tt.want {
+			t.Errorf("ignored(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIgnoredFinalName(t *testing.T) {
+	defer func(p string, z *zoneSettings) { namePrefix, zoneCfg = p, z }(namePrefix, zoneCfg)
+	rules, zones, err := parseRules("t.cfg", []byte("ignore stg-*.ssdv.win\nA $DROP.ssdv.win $PUB4\nA $DROP.ssdv.win $PUB4 private=pvt\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneCfg, namePrefix = zones, "stg-"
+	drop := godo.Droplet{ID: 1, Name: "web", Networks: &godo.Networks{V4: []godo.NetworkV4{
+		{IPAddress: "1.2.3.4", Type: "public"},
+		{IPAddress: "10.0.0.4", Type: "private"},
+	}}}
+	domains, _, err := desiredState(context.Background(), nil, rules, map[string][]Instance{sourceDroplets: {{Droplet: drop, Source: sourceDroplets}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dc := range domains {
+		for _, rec := range dc.Records {
+			t.Errorf("got record %s %s, but its final name is ignored", rec.Type, rec.NameFQDN)
+		}
+	}
+}
+
+func TestParseExcludeLines(t *testing.T) {
+	_, zones, err := parseRules("names.cfg", []byte("exclude [ci,build*] `^runner-`\nexclude `^tmp-`\nignore vpn.ssdv.win. *.Manual.ssdv.win\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zones.Excluded) != 2 || zones.Excluded[0].String() != "[ci,build*] `^runner-`" || zones.Excluded[1].String() != "`^tmp-`" {
+		t.Errorf("excluded = %v", zones.Excluded)
+	}
+	if want := []string{"vpn.ssdv.win", "*.manual.ssdv.win"}; len(zones.Ignored) != 2 || zones.Ignored[0] != want[0] || zones.Ignored[1] != want[1] {
+		t.Errorf("ignored = %q, want %q", zones.Ignored, want)
+	}
+	tests := []struct {
+		drop godo.Droplet
+		want bool
+	}{
+		// An exclude line with tags and a regex needs all of them.
+		{godo.Droplet{Name: "runner-1", Tags: []string{"ci", "buildkite"}}, true},
+		{godo.Droplet{Name: "runner-2", Tags: []string{"ci"}}, false},
+		{godo.Droplet{Name: "runner-3"}, false},
+		{godo.Droplet{Name: "web1", Tags: []string{"ci", "buildkite"}}, false},
+		{godo.Droplet{Name: "tmp-web1"}, true},
+	}
+	for _, tt := range tests {
+		if got := zones.excluded(tt.drop); got != tt.want {
+			t.Errorf("excluded(%s %v) = %v, want %v", tt.drop.Name, tt.drop.Tags, got, tt.want)
+		}
+	}
+}
+
+func TestParseExcludeLinesInvalid(t *testing.T) {
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{"exclude", "Exclude line needs at least"},
+		{"exclude runner", "Unexpected exclude part 'runner'"},
+		{"exclude `(`", "Bad exclude regex '`(`'"},
+		{"exclude [ci,]", "Bad tag pattern 'ci,': empty tag"},
+		{"ignore", "Ignore line needs at least 'ignore $NAME'"},
+		{"ignore [web.ssdv.win", "Bad ignore pattern '[web.ssdv.win'"},
+	}
+	for _, tt := range tests {
+		_, _, err := parseRules("names.cfg", []byte(tt.line+"\n"))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want %q", tt.line, err, tt.err)
+		}
+	}
+}
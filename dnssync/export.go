@@ -0,0 +1,117 @@
+package dnssync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+func sortedZones(domains map[string]*models.DomainConfig) []*models.DomainConfig {
+	zones := []*models.DomainConfig{}
+	for _, dc := range domains {
+		zones = append(zones, dc)
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].Name < zones[j].Name })
+	return zones
+}
+
+func writeExport(path string, domains map[string]*models.DomainConfig) error {
+	var dat []byte
+	if strings.HasSuffix(path, ".json") {
+		var err error
+		dat, err = json.MarshalIndent(&models.DNSConfig{Domains: sortedZones(domains)}, "", "  ")
+		if err != nil {
+			return err
+		}
+	} else {
+		dat = dnsconfigJS(domains)
+	}
+	return ioutil.WriteFile(path, dat, 0644)
+}
+
+// dnsconfigJS renders domains as a dnsconfig.js, with one DnsProvider
+// variable per provider in use.
+func dnsconfigJS(domains map[string]*models.DomainConfig) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "// Generated by do-dns-sync")
+	fmt.Fprintln(buf, `var REG_NONE = NewRegistrar("none", "NONE");`)
+	declared := map[string]bool{}
+	for _, dc := range sortedZones(domains) {
+		if p := zoneProvider(dc); !declared[p] {
+			declared[p] = true
+			fmt.Fprintf(buf, "var DSP_%s = NewDnsProvider(%q, %q);\n", strings.ToUpper(p), p, providerTypes[p])
+		}
+	}
+	for _, dc := range sortedZones(domains) {
+		fmt.Fprintf(buf, "\nD(%q, REG_NONE, DnsProvider(DSP_%s),\n", dc.Name, strings.ToUpper(zoneProvider(dc)))
+		for _, rec := range dc.Records {
+			meta, _ := json.Marshal(rec.Metadata)
+			switch rec.Type {
+			case "SRV":
+				fmt.Fprintf(buf, "  SRV(%q, %d, %d, %d, %q, TTL(%d), %s),\n", rec.Name, rec.SrvPriority, rec.SrvWeight, rec.SrvPort, rec.Target, rec.TTL, meta)
+			case "MX":
+				fmt.Fprintf(buf, "  MX(%q, %d, %q, TTL(%d), %s),\n", rec.Name, rec.MxPreference, rec.Target, rec.TTL, meta)
+			default:
+				fmt.Fprintf(buf, "  %s(%q, %q, TTL(%d), %s),\n", rec.Type, rec.Name, rec.Target, rec.TTL, meta)
+			}
+		}
+		fmt.Fprintln(buf, ");")
+	}
+	return buf.Bytes()
+}
+
+// bindZones renders domains as BIND zone files, one $ORIGIN section per
+// zone. Only the managed records are included, so there is no SOA or NS.
+func bindZones(domains map[string]*models.DomainConfig) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "; Generated by do-dns-sync")
+	for _, dc := range sortedZones(domains) {
+		fmt.Fprintf(buf, "\n$ORIGIN %s.\n", dc.Name)
+		for _, rec := range dc.Records {
+			switch rec.Type {
+			case "SRV":
+				fmt.Fprintf(buf, "%s\t%d\tIN\tSRV\t%d %d %d %s", rec.Name, rec.TTL, rec.SrvPriority, rec.SrvWeight, rec.SrvPort, withDot(rec.Target))
+			case "TXT":
+				fmt.Fprintf(buf, "%s\t%d\tIN\tTXT\t%s", rec.Name, rec.TTL, quoteTXT(rec.Target))
+			case "MX":
+				fmt.Fprintf(buf, "%s\t%d\tIN\tMX\t%d %s", rec.Name, rec.TTL, rec.MxPreference, withDot(rec.Target))
+			default:
+				fmt.Fprintf(buf, "%s\t%d\tIN\t%s\t%s", rec.Name, rec.TTL, rec.Type, rec.Target)
+			}
+			if comment := rec.Metadata["comment"]; comment != "" {
+				fmt.Fprintf(buf, "\t; %s", comment)
+			} else if id := rec.Metadata["rule"]; id != "" {
+				fmt.Fprintf(buf, "\t; rule %s", id)
+			}
+			fmt.Fprintln(buf)
+		}
+	}
+	return buf.Bytes()
+}
+
+// withDot returns name with a trailing dot.
+func withDot(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// recordString formats rec as a single zone-file-like line.
+func recordString(rec *models.RecordConfig) string {
+	if rec.Type == "SRV" {
+		return fmt.Sprintf("%s %d SRV %d %d %d %s", rec.NameFQDN, rec.TTL, rec.SrvPriority, rec.SrvWeight, rec.SrvPort, rec.Target)
+	}
+	if rec.Type == "TXT" {
+		return fmt.Sprintf("%s %d TXT %s", rec.NameFQDN, rec.TTL, quoteTXT(rec.Target))
+	}
+	if rec.Type == "MX" {
+		return fmt.Sprintf("%s %d MX %d %s", rec.NameFQDN, rec.TTL, rec.MxPreference, rec.Target)
+	}
+	return fmt.Sprintf("%s %d %s %s", rec.NameFQDN, rec.TTL, rec.Type, rec.Target)
+}
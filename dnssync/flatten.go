@@ -0,0 +1,68 @@
+package dnssync
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+// flattenTimeout bounds each lookup of a flattened CNAME's target.
+var flattenTimeout = envDuration("FLATTEN_TIMEOUT", 5*time.Second)
+
+// resolverCache looks up the addresses flattened CNAMEs point at, each
+// target at most once per sync.
+type resolverCache struct {
+	ctx   context.Context
+	addrs map[string][]net.IP
+	errs  map[string]error
+}
+
+func (r *resolverCache) lookup(host string) ([]net.IP, error) {
+	if ips, ok := r.addrs[host]; ok {
+		return ips, nil
+	}
+	if err, ok := r.errs[host]; ok {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, flattenTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("%s has no addresses", host)
+	}
+	if err != nil {
+		r.errs[host] = err
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].String() < ips[j].String() })
+	r.addrs[host] = ips
+	return ips, nil
+}
+
+// flatten replaces the CNAME rec with A and AAAA records for the current
+// addresses of its target, since a CNAME can't be at a zone's apex.
+func (r *resolverCache) flatten(rec *models.RecordConfig) ([]*models.RecordConfig, error) {
+	ips, err := r.lookup(canonicalName(rec.Target))
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]*models.RecordConfig, 0, len(ips))
+	for _, ip := range ips {
+		flat := *rec
+		flat.Type = "AAAA"
+		if ip.To4() != nil {
+			flat.Type = "A"
+		}
+		flat.Target = ip.String()
+		recs = append(recs, &flat)
+	}
+	return recs, nil
+}
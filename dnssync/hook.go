@@ -0,0 +1,34 @@
+package dnssync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// postApplyCmd is run through the shell after a sync that applied
+// corrections, whether or not it went on to fail. It gets one applied
+// correction per line on stdin, and their count in DO_DNS_SYNC_CHANGES.
+// When the sync failed after applying them, DO_DNS_SYNC_PARTIAL is 1 and
+// DO_DNS_SYNC_ERROR holds the error.
+var postApplyCmd = os.Getenv("POST_APPLY_CMD")
+
+func runPostApply(ctx context.Context, applied []string, syncErr error) {
+	if postApplyCmd == "" || len(applied) == 0 {
+		return
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", postApplyCmd)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("DO_DNS_SYNC_CHANGES=%d", len(applied)))
+	if syncErr != nil {
+		cmd.Env = append(cmd.Env, "DO_DNS_SYNC_PARTIAL=1", "DO_DNS_SYNC_ERROR="+syncErr.Error())
+	}
+	cmd.Stdin = strings.NewReader(strings.Join(applied, "\n") + "\n")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		slog.Error("Error running POST_APPLY_CMD", "error", err)
+	}
+}
@@ -0,0 +1,39 @@
+package dnssync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunPostApplyPartial(t *testing.T) {
+	defer func(c string) { postApplyCmd = c }(postApplyCmd)
+	out := filepath.Join(t.TempDir(), "hook")
+	postApplyCmd = `{ echo "$DO_DNS_SYNC_CHANGES ${DO_DNS_SYNC_PARTIAL:-0} $DO_DNS_SYNC_ERROR"; cat; } > ` + out
+	applied := []string{"CREATE A web.ssdv.win 1.2.3.4 ttl=100"}
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, "1 0 \nCREATE A web.ssdv.win 1.2.3.4 ttl=100\n"},
+		{errors.New("renaming droplet web: boom"), "1 1 renaming droplet web: boom\nCREATE A web.ssdv.win 1.2.3.4 ttl=100\n"},
+	}
+	for _, tt := range tests {
+		runPostApply(context.Background(), applied, tt.err)
+		got, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("sync error %v: hook got %q, want %q", tt.err, got, tt.want)
+		}
+	}
+
+	os.Remove(out)
+	runPostApply(context.Background(), nil, errors.New("boom"))
+	if _, err := os.Stat(out); err == nil {
+		t.Error("hook ran for a sync that applied nothing")
+	}
+}
@@ -0,0 +1,89 @@
+package dnssync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/digitalocean/godo"
+)
+
+// Import prints a best-effort names.cfg for zone's current records. A and
+// AAAA records whose address belongs to a droplet become rules pinned to
+// that droplet with name=; everything else is emitted commented out, since
+// rules can only produce records from droplets.
+func Import(ctx context.Context, c Config, zone string) error {
+	if err := configure(c); err != nil {
+		return err
+	}
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	src, err := newSource(sourceDroplets, client, "")
+	if err != nil {
+		return err
+	}
+	drops, err := src.List(ctx)
+	if err != nil {
+		return categorize(ErrListing, err)
+	}
+	owners := map[string]struct{ drop, v string }{}
+	for _, drop := range drops {
+		if ip, _ := drop.PublicIPv4(); ip != "" {
+			owners[ip] = struct{ drop, v string }{drop.Name, "$PUB4"}
+		}
+		if ip, _ := drop.PrivateIPv4(); ip != "" {
+			owners[ip] = struct{ drop, v string }{drop.Name, "$PRI4"}
+		}
+		if ip, _ := drop.PublicIPv6(); ip != "" {
+			owners[ip] = struct{ drop, v string }{drop.Name, "$PUB6"}
+		}
+	}
+	recs, err := listZoneRecords(ctx, client, zone)
+	if err != nil {
+		return categorize(ErrProvider, err)
+	}
+	fmt.Printf("# Imported from %s\n", zone)
+	for _, r := range recs {
+		fqdn := zone
+		if r.Name != "@" {
+			fqdn = r.Name + "." + zone
+		}
+		switch r.Type {
+		case "NS", "SOA":
+			continue
+		case "A", "AAAA":
+			if o, ok := owners[r.Data]; ok {
+				fmt.Printf("%s %s %s name=%s ttl=%d\n", r.Type, fqdn, o.v, o.drop, r.TTL)
+				continue
+			}
+			fmt.Printf("# %s %s %s ttl=%d (no droplet has this address)\n", r.Type, fqdn, r.Data, r.TTL)
+		case "SRV":
+			fmt.Printf("# SRV %s %s. %d weight=%d priority=%d ttl=%d (not tied to a droplet)\n", fqdn, r.Data, r.Port, r.Weight, r.Priority, r.TTL)
+		default:
+			fmt.Printf("# %s %s %s ttl=%d (unsupported)\n", r.Type, fqdn, r.Data, r.TTL)
+		}
+	}
+	return nil
+}
+
+func listZoneRecords(ctx context.Context, client *godo.Client, zone string) ([]godo.DomainRecord, error) {
+	list := []godo.DomainRecord{}
+	opt := &godo.ListOptions{}
+	for {
+		recs, resp, err := client.Domains.Records(ctx, zone, opt)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, recs...)
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opt.Page = page + 1
+	}
+	return list, nil
+}
@@ -0,0 +1,216 @@
+package dnssync
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jsonConfig is the structured form of a names config, used when its path
+// or URL ends in .json. It holds the same rules and zone settings as the
+// line format, plus sync options:
+//
+//	{
+//	  "version": "1",
+//	  "sync": {"interval": "5m", "ttl": 300, "prune": true, "no_delete": true},
+//	  "zones": {"ssdv.win": {"ttl": "300", "policy": "append-only"}},
+//	  "allowed_zones": ["ssdv.win"],
+//	  "exclude": [{"tags": ["ci"]}, {"regex": "^runner-"}],
+//	  "ignore": ["vpn.ssdv.win", "*.manual.ssdv.win"],
+//	  "rules": [
+//	    {"type": "A", "fqdn": "$DROP.ssdv.win", "target": "$PUB4", "tags": ["web"], "ttl": 300},
+//	    {"type": "SRV", "fqdn": "_http._tcp.ssdv.win", "target": "$DROP.ssdv.win.", "port": 80,
+//	     "options": {"weight": "vcpus", "id": "web-srv"}}
+//	  ]
+//	}
+type jsonConfig struct {
+	Version      string                       `json:"version"`
+	Sync         jsonSync                     `json:"sync"`
+	Zones        map[string]map[string]string `json:"zones"`
+	AllowedZones []string                     `json:"allowed_zones"`
+	Exclude      []jsonExclude                `json:"exclude"`
+	Ignore       []string                     `json:"ignore"`
+	Rules        []jsonRule                   `json:"rules"`
+}
+
+// jsonSync is the sync options of a jsonConfig. Interval is a duration
+// like "5m".
+type jsonSync struct {
+	Interval string `json:"interval"`
+	TTL      uint32 `json:"ttl"`
+	DryRun   bool   `json:"dry_run"`
+	Prune    bool   `json:"prune"`
+	NoDelete bool   `json:"no_delete"`
+}
+
+// syncSettings are the sync options a config file gives. Flags, Config and
+// the environment take precedence: the options fill in an Interval or TTL
+// left unset and turn on DryRun, Prune and NO_DELETE, but can't turn off
+// what those turned on.
+type syncSettings struct {
+	Interval time.Duration
+	TTL      uint32
+	DryRun   bool
+	Prune    bool
+	NoDelete bool
+}
+
+// apply fills in c from s.
+func (s syncSettings) apply(c *Config) {
+	if c.Interval == 0 {
+		c.Interval = s.Interval
+	}
+	if c.TTL == 0 {
+		c.TTL = s.TTL
+	}
+	c.DryRun = c.DryRun || s.DryRun
+	c.Prune = c.Prune || s.Prune
+}
+
+// settings checks s and converts it to syncSettings.
+func (s jsonSync) settings() (syncSettings, error) {
+	set := syncSettings{TTL: s.TTL, DryRun: s.DryRun, Prune: s.Prune, NoDelete: s.NoDelete}
+	if s.Interval != "" {
+		d, err := time.ParseDuration(s.Interval)
+		if err != nil || d <= 0 {
+			return set, fmt.Errorf("Bad sync interval '%s': want a positive duration like 5m", s.Interval)
+		}
+		set.Interval = d
+	}
+	if s.TTL > math.MaxInt32 {
+		return set, fmt.Errorf("Sync ttl must be at most %d, not %d", math.MaxInt32, s.TTL)
+	}
+	return set, nil
+}
+
+// jsonExclude is one droplet exclusion of a jsonConfig, like an exclude
+// line.
+type jsonExclude struct {
+	Tags  []string `json:"tags"`
+	Regex string   `json:"regex"`
+}
+
+// jsonRule is one rule of a jsonConfig. Options takes any option of the
+// line format, like id, weight or meta:key.
+type jsonRule struct {
+	Type      string            `json:"type"`
+	FQDN      string            `json:"fqdn"`
+	Target    string            `json:"target"`
+	TTL       uint32            `json:"ttl"`
+	Port      int               `json:"port"`
+	Tags      []string          `json:"tags"`
+	Regex     string            `json:"regex"`
+	Disabled  bool              `json:"disabled"`
+	Flatten   bool              `json:"flatten"`
+	PTR       bool              `json:"ptr"`
+	Aggregate bool              `json:"aggregate"`
+	Options   map[string]string `json:"options"`
+}
+
+// parseJSONRules parses the jsonConfig dat read from name.
+func parseJSONRules(name string, dat []byte) ([]*NameRule, *zoneSettings, error) {
+	var c jsonConfig
+	if err := json.Unmarshal(dat, &c); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", name, err)
+	}
+	if c.Version != "" {
+		if err := checkConfigVersion(c.Version); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	zones := newZoneSettings()
+	var err error
+	if zones.Sync, err = c.Sync.settings(); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	for zone, opts := range c.Zones {
+		parts := []string{"zone", zone}
+		for k, v := range opts {
+			parts = append(parts, k+"="+v)
+		}
+		if err := parseZoneLine(parts, zones); err != nil {
+			return nil, nil, fmt.Errorf("%s: zone %s: %w", name, zone, err)
+		}
+	}
+	if c.AllowedZones != nil {
+		zones.Allowed = map[string]bool{}
+		for _, zone := range c.AllowedZones {
+			zones.Allowed[canonicalName(zone)] = true
+		}
+	}
+	for i, e := range c.Exclude {
+		parts := []string{"exclude"}
+		if len(e.Tags) > 0 {
+			parts = append(parts, "["+strings.Join(e.Tags, ",")+"]")
+		}
+		if e.Regex != "" {
+			parts = append(parts, "`"+e.Regex+"`")
+		}
+		if err := parseExcludeLine(parts, zones); err != nil {
+			return nil, nil, fmt.Errorf("%s: exclude %d: %w", name, i+1, err)
+		}
+	}
+	if len(c.Ignore) > 0 {
+		if err := parseIgnoreLine(append([]string{"ignore"}, c.Ignore...), zones); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	rules := []*NameRule{}
+	for i, r := range c.Rules {
+		if err := r.add(&rules); err != nil {
+			return nil, nil, fmt.Errorf("%s: rule %d: %w", name, i+1, err)
+		}
+	}
+	return rules, zones, nil
+}
+
+// add converts r to a NameRule and adds it to rules.
+func (r jsonRule) add(rules *[]*NameRule) error {
+	if r.Type == "" || r.FQDN == "" || r.Target == "" {
+		return fmt.Errorf("Each rule needs a type, fqdn and target")
+	}
+	rule, err := newRule(r.Type, r.FQDN, r.Target)
+	if err != nil {
+		return err
+	}
+	rule.Disabled = rule.Disabled || r.Disabled
+	rule.Flatten = r.Flatten
+	rule.PTR = r.PTR
+	rule.Aggregate = r.Aggregate
+	if len(r.Tags) > 0 {
+		if err := rule.setOption("tag", strings.Join(r.Tags, ",")); err != nil {
+			return err
+		}
+	}
+	if r.Regex != "" {
+		if rule.Regex, err = regexp.Compile(r.Regex); err != nil {
+			return err
+		}
+	}
+	if r.TTL != 0 {
+		if err := rule.setOption("ttl", strconv.FormatUint(uint64(r.TTL), 10)); err != nil {
+			return err
+		}
+	}
+	if r.Port != 0 {
+		if err := rule.setOption("port", strconv.Itoa(r.Port)); err != nil {
+			return err
+		}
+	}
+	keys := make([]string, 0, len(r.Options))
+	for k := range r.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := rule.setOption(k, r.Options[k]); err != nil {
+			return err
+		}
+	}
+	return addRule(rules, rule)
+}
@@ -0,0 +1,74 @@
+package dnssync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONSyncOptions(t *testing.T) {
+	dat := []byte(`{
+  "sync": {"interval": "5m", "ttl": 300, "dry_run": true, "prune": true, "no_delete": true},
+  "rules": [{"type": "A", "fqdn": "$DROP.ssdv.win", "target": "$PUB4"}]
+}`)
+	_, zones, err := parseJSONRules("names.json", dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := syncSettings{Interval: 5 * time.Minute, TTL: 300, DryRun: true, Prune: true, NoDelete: true}
+	if zones.Sync != want {
+		t.Errorf("sync = %+v, want %+v", zones.Sync, want)
+	}
+
+	var c Config
+	zones.Sync.apply(&c)
+	if c.Interval != 5*time.Minute || c.TTL != 300 || !c.DryRun || !c.Prune {
+		t.Errorf("apply to an empty Config = %+v", c)
+	}
+	c = Config{Interval: time.Minute, TTL: 60}
+	zones.Sync.apply(&c)
+	if c.Interval != time.Minute || c.TTL != 60 {
+		t.Errorf("apply overrode the Config's interval and ttl: %+v", c)
+	}
+}
+
+func TestJSONSyncOptionsInvalid(t *testing.T) {
+	for _, sync := range []string{`{"interval": "soon"}`, `{"interval": "-1m"}`, `{"ttl": 4294967295}`} {
+		dat := []byte(`{"sync": ` + sync + `, "rules": []}`)
+		if _, _, err := parseJSONRules("names.json", dat); err == nil {
+			t.Errorf("sync %s parsed without error", sync)
+		}
+	}
+}
+
+func TestJSONConfigSkipsIncludes(t *testing.T) {
+	defer func(n string) { namesCfg = n }(namesCfg)
+	dir := t.TempDir()
+	namesCfg = filepath.Join(dir, "names.json")
+	// An include line isn't JSON, so it must fail to parse rather than
+	// pull in other.cfg.
+	if err := os.WriteFile(filepath.Join(dir, "other.cfg"), []byte("A $DROP.ssdv.win $PUB4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(namesCfg, []byte("include other.cfg\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := readRules(context.Background())
+	if err == nil || strings.Contains(err.Error(), "Including") || !strings.Contains(err.Error(), "names.json") {
+		t.Errorf("readRules = %v, want a JSON error", err)
+	}
+
+	if err := os.WriteFile(namesCfg, []byte(`{"rules": [{"type": "A", "fqdn": "$DROP.ssdv.win", "target": "$PUB4"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, _, err := readRules(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 {
+		t.Errorf("got %d rules, want 1", len(rules))
+	}
+}
@@ -0,0 +1,110 @@
+package dnssync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+// providerLimit describes limits a provider enforces on records. Zero
+// values mean no limit.
+type providerLimit struct {
+	// MaxTXTLength is the longest TXT value accepted.
+	MaxTXTLength int
+	// MaxRecords is the most records accepted in a single zone.
+	MaxRecords int
+	// Types are the record types the provider can manage. Nil means any.
+	Types map[string]bool
+	// MinTTL is the lowest TTL accepted. Lower TTLs are raised to it.
+	MinTTL uint32
+}
+
+var providerLimits = map[string]providerLimit{
+	"digitalocean": {
+		MaxTXTLength: 255,
+		MaxRecords:   envInt("DO_MAX_ZONE_RECORDS", 0),
+		MinTTL:       30,
+		Types: map[string]bool{
+			"A": true, "AAAA": true, "CAA": true, "CNAME": true,
+			"MX": true, "NS": true, "SRV": true, "TXT": true,
+		},
+	},
+	"cloudflare": {
+		MaxTXTLength: 2048,
+		MaxRecords:   envInt("CLOUDFLARE_MAX_ZONE_RECORDS", 0),
+		MinTTL:       60,
+		Types: map[string]bool{
+			"A": true, "AAAA": true, "CAA": true, "CNAME": true,
+			"MX": true, "NS": true, "SRV": true, "TXT": true,
+		},
+	},
+	"route53": {
+		MaxTXTLength: 255,
+		Types: map[string]bool{
+			"A": true, "AAAA": true, "CAA": true, "CNAME": true,
+			"MX": true, "NS": true, "PTR": true, "SRV": true, "TXT": true,
+		},
+	},
+}
+
+// supportedRules returns the rules whose provider can manage their record
+// type, warning about the rest, so one unsupported rule doesn't fail its
+// whole zone.
+func supportedRules(rules []*NameRule) []*NameRule {
+	supported := []*NameRule{}
+	for _, rule := range rules {
+		if types := providerLimits[rule.Provider].Types; types != nil && !types[rule.Type] {
+			rule.logf(slog.LevelWarn, "Skipping %s rule %s: provider %s doesn't support %s records", rule.Type, rule.FQDN, rule.Provider, rule.Type)
+			continue
+		}
+		supported = append(supported, rule)
+	}
+	return supported
+}
+
+// preflight drops records from dc that its provider would reject, logging
+// each one, so the rest of the zone can still be applied.
+func preflight(dc *models.DomainConfig, provider string) {
+	lim := providerLimits[provider]
+	kept := []*models.RecordConfig{}
+	for _, rec := range dc.Records {
+		if lim.MaxTXTLength > 0 && rec.Type == "TXT" && len(rec.Target) > lim.MaxTXTLength {
+			recordLogf(rec, slog.LevelWarn, "Skipping TXT record %s: value is %d characters, %s allows %d", rec.NameFQDN, len(rec.Target), provider, lim.MaxTXTLength)
+			continue
+		}
+		if lim.MaxRecords > 0 && len(kept) >= lim.MaxRecords {
+			recordLogf(rec, slog.LevelWarn, "Skipping %s record %s: zone %s is at the %s limit of %d records", rec.Type, rec.NameFQDN, dc.Name, provider, lim.MaxRecords)
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	dc.Records = kept
+}
+
+// checkNameLength checks name against the DNS limits of 63 octets per label
+// and 253 for the whole name without its trailing dot.
+func checkNameLength(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return fmt.Errorf("name is %d octets, the limit is 253", len(name))
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > 63 {
+			return fmt.Errorf("label %s is %d octets, the limit is 63", label, len(label))
+		}
+	}
+	return nil
+}
+
+// recordLogf logs a message about rec at level, tagged with the id of the
+// rule that produced it if it has one.
+func recordLogf(rec *models.RecordConfig, level slog.Level, format string, args ...interface{}) {
+	var attrs []interface{}
+	if id := rec.Metadata["rule"]; id != "" {
+		attrs = append(attrs, "rule", id)
+	}
+	slog.Log(context.Background(), level, fmt.Sprintf(format, args...), attrs...)
+}
@@ -0,0 +1,92 @@
+package dnssync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// rulesOverlap reports whether a and b can both match one droplet. Regexes
+// can't be compared in general, so only filters that plainly exclude each
+// other count as disjoint.
+func rulesOverlap(a, b *NameRule) bool {
+	if a.Fallback != "" || b.Fallback != "" {
+		// A fallback only produces records when its rule produced none.
+		return false
+	}
+	differ := func(x, y string) bool { return x != "" && y != "" && x != y }
+	if differ(a.DropletName, b.DropletName) || differ(a.Region, b.Region) ||
+		differ(a.Feature, b.Feature) || differ(a.Project, b.Project) {
+		return false
+	}
+	// Labels requiring several tags can overlap even when they differ.
+	multi := strings.Contains(a.Label+b.Label, ",")
+	if differ(a.Label, b.Label) && !isGlob(a.Label) && !isGlob(b.Label) && !multi && !tagIgnoreCase {
+		return false
+	}
+	return true
+}
+
+// lintRules returns a warning for each pair of enabled rules that share a
+// record type and name template and can match the same droplet.
+func lintRules(rules []*NameRule) []string {
+	var warnings []string
+	for i, a := range rules {
+		for j, b := range rules[i+1:] {
+			if a.Disabled || b.Disabled || a.Type != b.Type || a.PrivateLabel != b.PrivateLabel || !rulesOverlap(a, b) {
+				continue
+			}
+			for _, an := range a.Names() {
+				for _, bn := range b.Names() {
+					if strings.EqualFold(an, bn) {
+						warnings = append(warnings, fmt.Sprintf("%s rules %s and %s can both produce %s for the same droplet", a.Type, ruleRef(a, i), ruleRef(b, i+1+j), an))
+					}
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// ruleRef names the i'th rule in lint output, by its id if it has one.
+func ruleRef(r *NameRule, i int) string {
+	if r.ID != "" {
+		return r.ID
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// Check loads the rules of c, without any DigitalOcean API access, and
+// returns the first problem with them.
+func Check(c Config) error {
+	if err := configure(c); err != nil {
+		return err
+	}
+	rules, err := LoadRules(context.Background())
+	if err != nil {
+		return err
+	}
+	slog.Info("Rules OK", "config", namesCfg, "rules", len(rules))
+	return nil
+}
+
+// Lint checks the config for rules that can produce the same name and type
+// for one droplet, printing each pair.
+func Lint(c Config) error {
+	if err := configure(c); err != nil {
+		return err
+	}
+	rules, err := LoadRules(context.Background())
+	if err != nil {
+		return err
+	}
+	warnings := lintRules(rules)
+	for _, w := range warnings {
+		fmt.Println(w)
+	}
+	if len(warnings) > 0 {
+		return fmt.Errorf("%d overlapping rules in %s", len(warnings), namesCfg)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package dnssync
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// metadataTimeout bounds each metadata fetch.
+var metadataTimeout = envDuration("METADATA_TIMEOUT", 5*time.Second)
+
+// metadataCache fetches the values rules with meta= expose as $META, each
+// URL at most once per sync. DigitalOcean's metadata service only answers
+// requests from the droplet itself, so the URL is usually an endpoint the
+// droplet serves its own metadata on, like http://$PRI4:8080/metadata/v1/hostname.
+type metadataCache struct {
+	ctx    context.Context
+	values map[string]string
+	errs   map[string]error
+}
+
+func (m *metadataCache) get(url string) (string, error) {
+	if v, ok := m.values[url]; ok {
+		return v, nil
+	}
+	if err, ok := m.errs[url]; ok {
+		return "", err
+	}
+	v, err := fetchMetadata(m.ctx, url)
+	if err != nil {
+		m.errs[url] = err
+		return "", err
+	}
+	m.values[url] = v
+	return v, nil
+}
+
+func fetchMetadata(ctx context.Context, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Fetching %s returned %s", url, resp.Status)
+	}
+	dat, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(dat)), nil
+}
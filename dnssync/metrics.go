@@ -0,0 +1,345 @@
+package dnssync
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/StackExchange/dnscontrol/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var zoneRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "do_dns_sync_zone_records",
+	Help: "Number of records managed in each zone as of the last sync.",
+}, []string{"zone"})
+
+var apiCalls = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "do_dns_sync_api_calls_total",
+	Help: "DigitalOcean API calls made by all syncs.",
+})
+
+var lastAPICalls = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "do_dns_sync_last_api_calls",
+	Help: "DigitalOcean API calls made by the last sync.",
+})
+
+var staleRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "do_dns_sync_stale_records",
+	Help: "Records in each zone that REPORT_DELETES left in place instead of deleting.",
+}, []string{"zone"})
+
+var driftRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "do_dns_sync_drift_records",
+	Help: "Records in each zone that differed from the desired state at the last sync, whether or not they were corrected.",
+}, []string{"zone"})
+
+var lastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "do_dns_sync_last_success_timestamp_seconds",
+	Help: "Unix time the last successful sync finished.",
+})
+
+var syncs = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "do_dns_sync_syncs_total",
+	Help: "Syncs run.",
+})
+
+var failedSyncs = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "do_dns_sync_failed_syncs_total",
+	Help: "Syncs that ended with an error.",
+})
+
+var lastDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "do_dns_sync_last_duration_seconds",
+	Help: "How long the last sync took.",
+})
+
+var lastCorrections = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "do_dns_sync_last_corrections",
+	Help: "Corrections applied by the last sync.",
+})
+
+var dropletsListed = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "do_dns_sync_droplets",
+	Help: "Droplets listed by the last sync.",
+})
+
+var syncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "do_dns_sync_sync_duration_seconds",
+	Help:    "How long syncs took.",
+	Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+})
+
+var appliedCorrections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "do_dns_sync_corrections_total",
+	Help: "Corrections applied by all syncs, by zone and action: create, modify or delete.",
+}, []string{"zone", "action"})
+
+var syncErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "do_dns_sync_errors_total",
+	Help: "Syncs that ended with an error, by kind: config, provider, listing or other.",
+}, []string{"kind"})
+
+var configLoaded = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "do_dns_sync_config_loaded",
+	Help: "1 if the names config last loaded without errors, 0 if the last known good rules are in use.",
+})
+
+var configLoadedAt = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "do_dns_sync_config_last_load_timestamp_seconds",
+	Help: "Unix time the names config last loaded without errors.",
+})
+
+func init() {
+	prometheus.MustRegister(zoneRecords, apiCalls, lastAPICalls, staleRecords, driftRecords, lastSuccess,
+		syncs, failedSyncs, lastDuration, lastCorrections, dropletsListed,
+		syncDuration, appliedCorrections, syncErrors, consecutiveFailures, configLoaded, configLoadedAt)
+}
+
+// healthFailures, when set, is how many syncs in a row may fail before
+// /healthz reports unhealthy, however recently a sync succeeded.
+var healthFailures = envInt("HEALTH_MAX_FAILURES", 3)
+
+var consecutiveFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "do_dns_sync_consecutive_failures",
+	Help: "Syncs in a row that ended with an error.",
+})
+
+// syncHealth is the outcome of the latest syncs, for /healthz and /readyz.
+type syncHealth struct {
+	LastSync            *time.Time `json:"last_sync,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	SecondsSinceSuccess float64    `json:"seconds_since_success,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Healthy             bool       `json:"healthy"`
+	Ready               bool       `json:"ready"`
+}
+
+var (
+	healthMu sync.Mutex
+	health   syncHealth
+)
+
+// observeSync updates the sync metrics for a sync that started at start
+// and ended with sum and err.
+func observeSync(start time.Time, sum Summary, err error) {
+	syncs.Inc()
+	lastDuration.Set(time.Since(start).Seconds())
+	syncDuration.Observe(time.Since(start).Seconds())
+	lastCorrections.Set(float64(len(sum.Applied)))
+	for _, a := range sum.Applied {
+		parts := strings.SplitN(a, ": ", 2)
+		if len(parts) == 2 {
+			action := strings.ToLower(strings.SplitN(parts[1], " ", 2)[0])
+			appliedCorrections.WithLabelValues(parts[0], action).Inc()
+		}
+	}
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	now := time.Now()
+	health.LastSync = &now
+	if err != nil {
+		failedSyncs.Inc()
+		syncErrors.WithLabelValues(errorKind(err)).Inc()
+		health.LastError = err.Error()
+		health.ConsecutiveFailures++
+		consecutiveFailures.Set(float64(health.ConsecutiveFailures))
+		return
+	}
+	lastSuccess.SetToCurrentTime()
+	health.LastSuccess = health.LastSync
+	health.LastError = ""
+	health.ConsecutiveFailures = 0
+	consecutiveFailures.Set(0)
+}
+
+// currentHealth returns the outcome of the latest syncs. A sync is healthy
+// when one succeeded within the last three sync intervals and fewer than
+// HEALTH_MAX_FAILURES have failed since, and ready when the last one
+// succeeded.
+func currentHealth() syncHealth {
+	healthMu.Lock()
+	h := health
+	healthMu.Unlock()
+	if h.LastSuccess != nil {
+		h.SecondsSinceSuccess = time.Since(*h.LastSuccess).Seconds()
+		h.Healthy = time.Since(*h.LastSuccess) <= 3*runInterval(cfg) &&
+			(healthFailures <= 0 || h.ConsecutiveFailures < healthFailures)
+		h.Ready = h.ConsecutiveFailures == 0
+	}
+	return h
+}
+
+// errorKind names the category of err for do_dns_sync_errors_total.
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrConfig):
+		return "config"
+	case errors.Is(err, ErrProvider):
+		return "provider"
+	case errors.Is(err, ErrListing):
+		return "listing"
+	}
+	return "other"
+}
+
+// serveHealth is the liveness check: it fails when syncing has stopped
+// succeeding.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	h := currentHealth()
+	writeHealth(w, h, h.Healthy)
+}
+
+// serveReady is the readiness check: it fails until a sync succeeds, and
+// whenever the last one failed.
+func serveReady(w http.ResponseWriter, r *http.Request) {
+	h := currentHealth()
+	writeHealth(w, h, h.Ready)
+}
+
+// writeHealth writes h as JSON, with status 503 unless ok.
+func writeHealth(w http.ResponseWriter, h syncHealth, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(h)
+}
+
+// ServeMetrics serves the Prometheus metrics on /metrics, the desired
+// records and skipped records of the last sync on /records and /skipped,
+// liveness and readiness checks on /healthz and /readyz, and POST /sync to
+// trigger a sync.
+func ServeMetrics(addr string) error {
+	slog.Info("Serving metrics", "addr", addr)
+	return http.ListenAndServe(addr, metricsMux(addr))
+}
+
+// metricsMux returns the handlers ServeMetrics serves on addr. POST /sync
+// is left out unless SYNC_TRIGGER_TOKEN is set or addr is a loopback
+// address, so anyone who can reach the port can't trigger syncs.
+func metricsMux(addr string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/records", serveRecords)
+	mux.HandleFunc("/skipped", serveSkipped)
+	mux.HandleFunc("/healthz", serveHealth)
+	mux.HandleFunc("/readyz", serveReady)
+	if triggerToken != "" || loopbackAddr(addr) {
+		mux.HandleFunc("/sync", serveTrigger)
+	} else {
+		slog.Warn("Not serving POST /sync: set SYNC_TRIGGER_TOKEN, or listen on localhost", "addr", addr)
+	}
+	return mux
+}
+
+// loopbackAddr reports whether addr, a host:port, only listens on a
+// loopback interface.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+var (
+	stateMu sync.Mutex
+	// desired is the desired state computed by the last sync.
+	desired []*models.DomainConfig
+)
+
+// publishState updates the zone metrics and /records from the desired state
+// computed by a sync.
+func publishState(domains map[string]*models.DomainConfig) {
+	zoneRecords.Reset()
+	for name, dc := range domains {
+		zoneRecords.WithLabelValues(name).Set(float64(len(dc.Records)))
+	}
+	stateMu.Lock()
+	desired = sortedZones(domains)
+	stateMu.Unlock()
+}
+
+func serveRecords(w http.ResponseWriter, r *http.Request) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(&models.DNSConfig{Domains: desired})
+}
+
+func serveSkipped(w http.ResponseWriter, r *http.Request) {
+	skippedMu.Lock()
+	defer skippedMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(lastSkipped)
+}
+
+// callCounter counts the DigitalOcean API requests of one sync.
+type callCounter struct {
+	n int64
+}
+
+func (c *callCounter) inc() {
+	atomic.AddInt64(&c.n, 1)
+}
+
+func (c *callCounter) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// doAPIHost is the host whose requests countRequests counts.
+var doAPIHost = "api.digitalocean.com"
+
+var (
+	// syncCalls counts the requests of the running sync, when there is one.
+	syncCalls    atomic.Pointer[callCounter]
+	countingOnce sync.Once
+)
+
+// countRequests wraps http.DefaultTransport so every request to the
+// DigitalOcean API is throttled under API_RATE_LIMIT and counted in
+// syncCalls. The dnscontrol provider builds its client from a token on the
+// default transport, so this is where its requests can be seen; requests
+// to other hosts, like those of other providers, pass through untouched.
+func countRequests() {
+	countingOnce.Do(func() {
+		base := http.DefaultTransport
+		http.DefaultTransport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host != doAPIHost {
+				return base.RoundTrip(req)
+			}
+			if err := throttle(req.Context()); err != nil {
+				return nil, err
+			}
+			if c := syncCalls.Load(); c != nil {
+				c.inc()
+			}
+			return base.RoundTrip(req)
+		})
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,69 @@
+package dnssync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+func TestCountRequestsOnlyDigitalOcean(t *testing.T) {
+	defer func(h string, r int) { doAPIHost, apiRateLimit = h, r }(doAPIHost, apiRateLimit)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	do := httptest.NewServer(ok)
+	defer do.Close()
+	other := httptest.NewServer(ok)
+	defer other.Close()
+	u, _ := url.Parse(do.URL)
+	doAPIHost = u.Host
+	countRequests()
+	calls := &callCounter{}
+	syncCalls.Store(calls)
+	defer syncCalls.Store(nil)
+
+	get := func(url string) func() error {
+		return func() error {
+			resp, err := http.Get(url)
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		}
+	}
+	dc := &models.DomainConfig{Name: "ssdv.win"}
+	corrs := []*models.Correction{
+		{Msg: "CREATE A web.ssdv.win 1.2.3.4 ttl=100", F: get(do.URL + "/v2/domains/ssdv.win/records")},
+		{Msg: "DELETE A app.ssdv.win 1.2.3.5 ttl=100", F: get(do.URL + "/v2/domains/ssdv.win/records/1")},
+		// A correction from another provider, and one with nothing to run.
+		{Msg: "CREATE A www.ssdv.win 1.2.3.6 ttl=100", F: get(other.URL + "/zones")},
+		{Msg: "Zone ssdv.win has 3 changes"},
+	}
+	if _, err := applyZone(context.Background(), dc, corrs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.count(); n != 2 {
+		t.Errorf("counted %d calls, want the 2 DigitalOcean requests", n)
+	}
+
+	// Other hosts aren't throttled, even under a rate limit.
+	apiRateLimit = 1
+	throttleMu.Lock()
+	before := nextCall
+	throttleMu.Unlock()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := get(other.URL)(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	throttleMu.Lock()
+	after := nextCall
+	throttleMu.Unlock()
+	if !after.Equal(before) || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("requests to another host were throttled")
+	}
+}
@@ -0,0 +1,42 @@
+package dnssync
+
+import "testing"
+
+func TestCanonicalName(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"web.ssdv.win", "web.ssdv.win"},
+		{"web.ssdv.win.", "web.ssdv.win"},
+		{"Web.SSDV.win.", "web.ssdv.win"},
+		{"ssdv.win.", "ssdv.win"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := canonicalName(tt.in); got != tt.want {
+			t.Errorf("canonicalName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestZoneFor(t *testing.T) {
+	tests := []struct {
+		zone, fqdn, want string
+		err              bool
+	}{
+		{"", "web.ssdv.win", "ssdv.win", false},
+		{"", "Web.SSDV.win.", "ssdv.win", false},
+		{"", "ssdv.win", "ssdv.win", false},
+		{"", "ssdv.win.", "ssdv.win", false},
+		{"", "a.b.example.co.uk", "example.co.uk", false},
+		{"int.ssdv.win", "web.int.ssdv.win", "int.ssdv.win", false},
+		{"int.ssdv.win", "WEB.Int.ssdv.win.", "int.ssdv.win", false},
+		{"int.ssdv.win", "int.ssdv.win.", "int.ssdv.win", false},
+		{"int.ssdv.win", "web.ssdv.win", "", true},
+		{"int.ssdv.win", "xint.ssdv.win", "", true},
+	}
+	for _, tt := range tests {
+		got, err := zoneFor(&NameRule{Zone: tt.zone}, tt.fqdn)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("zoneFor(zone=%q, %q) = %q, %v, want %q", tt.zone, tt.fqdn, got, err, tt.want)
+		}
+	}
+}
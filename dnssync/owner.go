@@ -0,0 +1,147 @@
+package dnssync
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/StackExchange/dnscontrol/models"
+	"github.com/miekg/dns/dnsutil"
+)
+
+// txtOwnerID, when set, marks every name this tool syncs with a companion
+// TXT record at txtOwnerPrefix plus the name, like external-dns does. Only
+// records at names whose marks already exist in the zone are modified or
+// deleted, so records made by hand or by an instance with another id are
+// left alone, while the records of droplets that are gone are cleaned up
+// along with their marks. A name is only claimed when it's created fresh.
+var (
+	txtOwnerID     = os.Getenv("TXT_OWNER_ID")
+	txtOwnerPrefix = envOr("TXT_OWNER_PREFIX", "_owner.")
+)
+
+// ownerWildcard replaces the * of a wildcard name in its ownership record's
+// name, since * is only valid as the leftmost label.
+const ownerWildcard = "_wildcard"
+
+// ownerValue is the value of this instance's ownership TXT records.
+func ownerValue() string {
+	return "heritage=do-dns-sync,owner=" + txtOwnerID
+}
+
+// ownerName returns the name of the ownership record of name.
+func ownerName(name string) string {
+	if name == "*" || strings.HasPrefix(name, "*.") {
+		name = ownerWildcard + strings.TrimPrefix(name, "*")
+	}
+	return txtOwnerPrefix + name
+}
+
+// ownedName returns the name the ownership record at name marks, or name
+// itself if it isn't an ownership record's.
+func ownedName(name string) string {
+	name = canonicalName(name)
+	if !isOwnerName(name) {
+		return name
+	}
+	name = strings.TrimPrefix(name, txtOwnerPrefix)
+	if name == ownerWildcard || strings.HasPrefix(name, ownerWildcard+".") {
+		name = "*" + strings.TrimPrefix(name, ownerWildcard)
+	}
+	return name
+}
+
+// addOwnerRecords adds an ownership TXT record for each name in domains.
+func addOwnerRecords(domains map[string]*models.DomainConfig) {
+	if txtOwnerID == "" {
+		return
+	}
+	for _, dc := range domains {
+		first := map[string]*models.RecordConfig{}
+		for _, rec := range dc.Records {
+			if _, ok := first[rec.NameFQDN]; !ok && !isOwnerName(rec.NameFQDN) {
+				first[rec.NameFQDN] = rec
+			}
+		}
+		names := make([]string, 0, len(first))
+		for name := range first {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fqdn := ownerName(name)
+			dc.Records = append(dc.Records, &models.RecordConfig{
+				Type:       "TXT",
+				Name:       dnsutil.TrimDomainName(fqdn, dc.Name),
+				NameFQDN:   fqdn,
+				Target:     ownerValue(),
+				TxtStrings: []string{ownerValue()},
+				TTL:        first[name].TTL,
+				Metadata:   map[string]string{"managed-by": "do-dns-sync"},
+			})
+		}
+	}
+}
+
+// isOwnerName reports whether name is that of an ownership TXT record.
+func isOwnerName(name string) bool {
+	return strings.HasPrefix(name, txtOwnerPrefix)
+}
+
+// heldNames returns the names of dc this instance must leave alone under
+// TXT_OWNER_ID, going by the ownership records already in the zone, which
+// corrs, the diff against it, gives away: a mark dc wants that corrs
+// neither create nor modify is already there with this instance's value,
+// and one corrs delete with that value was there too. A name that isn't
+// owned so but has records corrs would modify or delete, its mark
+// included, holds records made by hand or by another instance. The rest
+// are new names, which are claimed by creating them and their marks.
+func heldNames(dc *models.DomainConfig, corrs []*models.Correction) map[string]bool {
+	owned, held := map[string]bool{}, map[string]bool{}
+	changed := map[string]bool{}
+	for _, c := range corrs {
+		if name := correctionName(c); isOwnerName(name) && !isDelete(c) {
+			changed[ownedName(name)] = true
+		}
+	}
+	for _, rec := range dc.Records {
+		if name := rec.NameFQDN; isOwnerName(name) && !changed[ownedName(name)] {
+			owned[ownedName(name)] = true
+		}
+	}
+	for _, c := range corrs {
+		if ownerDelete(c) {
+			owned[ownedName(correctionName(c))] = true
+		}
+	}
+	for _, c := range corrs {
+		name := ownedName(correctionName(c))
+		if !owned[name] && !strings.HasPrefix(c.Msg, "CREATE") {
+			held[name] = true
+		}
+	}
+	return held
+}
+
+// ownerDelete reports whether c deletes one of this instance's ownership
+// records. The value must be this instance's exactly, so an owner id that
+// another one starts with, like a for ab, doesn't claim its records.
+func ownerDelete(c *models.Correction) bool {
+	return isDelete(c) && correctionType(c) == "TXT" && isOwnerName(correctionName(c)) &&
+		txtValue(parseCorrection("", c).Old) == ownerValue()
+}
+
+// ttlSuffix matches the TTL a correction message gives after a value.
+var ttlSuffix = regexp.MustCompile(`\s+ttl=\d+$`)
+
+// txtValue returns the TXT value in old, the record part of a correction
+// message like `"heritage=do-dns-sync,owner=a" ttl=100`, without its TTL
+// and quotes.
+func txtValue(old string) string {
+	v := strings.TrimSpace(ttlSuffix.ReplaceAllString(strings.TrimSpace(old), ""))
+	if len(v) >= 2 && strings.HasPrefix(v, `"`) && strings.HasSuffix(v, `"`) {
+		v = unquoteTXT(v)
+	}
+	return v
+}
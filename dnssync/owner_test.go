@@ -0,0 +1,135 @@
+package dnssync
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+func TestOwnerDelete(t *testing.T) {
+	defer func(id string) { txtOwnerID = id }(txtOwnerID)
+	txtOwnerID = "a"
+	tests := []struct {
+		msg  string
+		want bool
+	}{
+		{`DELETE TXT _owner.web.ssdv.win heritage=do-dns-sync,owner=a ttl=100`, true},
+		{`DELETE TXT _owner.web.ssdv.win "heritage=do-dns-sync,owner=a" ttl=100`, true},
+		{`DELETE TXT _owner.web.ssdv.win heritage=do-dns-sync,owner=ab ttl=100`, false},
+		{`DELETE TXT _owner.web.ssdv.win "heritage=do-dns-sync,owner=ab" ttl=100`, false},
+		{`DELETE TXT _owner.web.ssdv.win "heritage=do-dns-sync,owner=" ttl=100`, false},
+		{`DELETE TXT web.ssdv.win heritage=do-dns-sync,owner=a ttl=100`, false},
+		{`CREATE TXT _owner.web.ssdv.win heritage=do-dns-sync,owner=a ttl=100`, false},
+	}
+	for _, tt := range tests {
+		if got := ownerDelete(&models.Correction{Msg: tt.msg}); got != tt.want {
+			t.Errorf("ownerDelete(%q) = %v, want %v", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func ownerTXT(name string) *models.RecordConfig {
+	return &models.RecordConfig{Type: "TXT", NameFQDN: ownerName(name), Target: ownerValue()}
+}
+
+func TestHeldNames(t *testing.T) {
+	defer func(id string) { txtOwnerID = id }(txtOwnerID)
+	txtOwnerID = "a"
+	dc := &models.DomainConfig{Name: "ssdv.win", Records: []*models.RecordConfig{
+		{Type: "A", NameFQDN: "web.ssdv.win"}, ownerTXT("web.ssdv.win"),
+		{Type: "A", NameFQDN: "manual.ssdv.win"}, ownerTXT("manual.ssdv.win"),
+		{Type: "A", NameFQDN: "new.ssdv.win"}, ownerTXT("new.ssdv.win"),
+		{Type: "A", NameFQDN: "theirs.ssdv.win"}, ownerTXT("theirs.ssdv.win"),
+	}}
+	corrs := []*models.Correction{
+		// web's mark is already in the zone, so it's owned.
+		{Msg: `MODIFY A web.ssdv.win: (1.2.3.4 ttl=100) -> (1.2.3.5 ttl=100)`},
+		// manual has a record made by hand and no mark yet.
+		{Msg: `MODIFY A manual.ssdv.win: (5.6.7.8 ttl=100) -> (1.2.3.6 ttl=100)`},
+		{Msg: `CREATE TXT _owner.manual.ssdv.win "heritage=do-dns-sync,owner=a" ttl=100`},
+		// new is created fresh, along with its mark.
+		{Msg: `CREATE A new.ssdv.win 1.2.3.7 ttl=100`},
+		{Msg: `CREATE TXT _owner.new.ssdv.win "heritage=do-dns-sync,owner=a" ttl=100`},
+		// theirs is marked by owner ab.
+		{Msg: `MODIFY TXT _owner.theirs.ssdv.win: ("heritage=do-dns-sync,owner=ab" ttl=100) -> ("heritage=do-dns-sync,owner=a" ttl=100)`},
+		// old is gone from the config, along with its mark.
+		{Msg: `DELETE A old.ssdv.win 1.2.3.8 ttl=100`},
+		{Msg: `DELETE TXT _owner.old.ssdv.win "heritage=do-dns-sync,owner=a" ttl=100`},
+		// stray isn't marked at all.
+		{Msg: `DELETE A stray.ssdv.win 1.2.3.9 ttl=100`},
+	}
+	held := heldNames(dc, corrs)
+	for name, want := range map[string]bool{
+		"web.ssdv.win": false, "manual.ssdv.win": true, "new.ssdv.win": false,
+		"theirs.ssdv.win": true, "old.ssdv.win": false, "stray.ssdv.win": true,
+	} {
+		if held[name] != want {
+			t.Errorf("held[%s] = %v, want %v", name, held[name], want)
+		}
+	}
+}
+
+func TestHeldNamesSharedPrefix(t *testing.T) {
+	defer func(id string) { txtOwnerID = id }(txtOwnerID)
+	txtOwnerID = "a"
+	dc := &models.DomainConfig{Name: "ssdv.win"}
+	corrs := []*models.Correction{
+		{Msg: `DELETE TXT _owner.web.ssdv.win "heritage=do-dns-sync,owner=ab" ttl=100`},
+		{Msg: `DELETE A web.ssdv.win 1.2.3.4 ttl=100`},
+	}
+	if !heldNames(dc, corrs)["web.ssdv.win"] {
+		t.Errorf("owner a claims web.ssdv.win of owner ab")
+	}
+}
+
+func TestOwnerNameWildcard(t *testing.T) {
+	tests := []struct{ name, owner string }{
+		{"web.ssdv.win", "_owner.web.ssdv.win"},
+		{"*.x.ssdv.win", "_owner._wildcard.x.ssdv.win"},
+		{"ssdv.win", "_owner.ssdv.win"},
+	}
+	for _, tt := range tests {
+		got := ownerName(tt.name)
+		if got != tt.owner {
+			t.Errorf("ownerName(%q) = %q, want %q", tt.name, got, tt.owner)
+		}
+		if strings.Contains(got, "*") {
+			t.Errorf("ownerName(%q) = %q has a *", tt.name, got)
+		}
+		if back := ownedName(got); back != tt.name {
+			t.Errorf("ownedName(%q) = %q, want %q", got, back, tt.name)
+		}
+	}
+}
+
+func TestAddOwnerRecordsWildcard(t *testing.T) {
+	defer func(id string) { txtOwnerID = id }(txtOwnerID)
+	txtOwnerID = "a"
+	dc := &models.DomainConfig{Name: "ssdv.win", Records: []*models.RecordConfig{{Type: "A", Name: "*.x", NameFQDN: "*.x.ssdv.win"}}}
+	addOwnerRecords(map[string]*models.DomainConfig{dc.Name: dc})
+	if len(dc.Records) != 2 {
+		t.Fatalf("got %d records, want 2", len(dc.Records))
+	}
+	if rec := dc.Records[1]; rec.NameFQDN != "_owner._wildcard.x.ssdv.win" || rec.Name != "_owner._wildcard.x" {
+		t.Errorf("owner record at %s (%s), want _owner._wildcard.x.ssdv.win", rec.NameFQDN, rec.Name)
+	}
+}
+
+func TestFilterCorrectionsKeepsHandMadeRecords(t *testing.T) {
+	defer func(id string) { txtOwnerID = id }(txtOwnerID)
+	txtOwnerID = "a"
+	dc := &models.DomainConfig{Name: "ssdv.win", Records: []*models.RecordConfig{
+		{Type: "A", NameFQDN: "manual.ssdv.win"}, ownerTXT("manual.ssdv.win"),
+	}}
+	corrs := []*models.Correction{
+		{Msg: `MODIFY A manual.ssdv.win: (5.6.7.8 ttl=100) -> (1.2.3.6 ttl=100)`},
+		{Msg: `CREATE TXT _owner.manual.ssdv.win "heritage=do-dns-sync,owner=a" ttl=100`},
+		{Msg: `DELETE TXT manual.ssdv.win "v=spf1 -all" ttl=100`},
+	}
+	if kept := filterCorrections(dc, corrs, false); len(kept) != 0 {
+		for _, c := range kept {
+			t.Errorf("applied %s to a name made by hand", c.Msg)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package dnssync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+// plannedChange is one correction a Plan sync would have applied.
+type plannedChange struct {
+	Zone   string `json:"zone"`
+	Action string `json:"action"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+	Msg    string `json:"msg"`
+}
+
+// planned collects the changes of a Plan sync.
+var planned = []plannedChange{}
+
+// planCorrection records c as a planned change to dc, and reports it as
+// a dry-run line with what the record was and would become.
+func planCorrection(dc *models.DomainConfig, c *models.Correction) {
+	p := parseCorrection(dc.Name, c)
+	planned = append(planned, p)
+	if c.F == nil {
+		reportChange(dc, reportAll, "DRY-RUN", c, nil, "[DRY-RUN]", c.Msg)
+		return
+	}
+	reportChange(dc, reportChanges, "DRY-RUN", c, nil, "[DRY-RUN]", dryRunLine(p)+correctionRules(dc, c))
+}
+
+// reportPlanCounts reports how many records corrs would create, modify and
+// delete in zone.
+func reportPlanCounts(zone string, corrs []*models.Correction) {
+	counts := map[string]int{}
+	for _, c := range corrs {
+		if c.F != nil {
+			counts[parseCorrection(zone, c).Action]++
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+	reportln(zone, reportChanges, fmt.Sprintf("[DRY-RUN] %s: %d to create, %d to modify, %d to delete", zone, counts["CREATE"], counts["MODIFY"], counts["DELETE"]))
+}
+
+// dryRunLine spells out p's before and after values, falling back to the
+// correction message when it didn't parse.
+func dryRunLine(p plannedChange) string {
+	if p.Old == "" && p.New == "" {
+		return p.Msg
+	}
+	line := fmt.Sprintf("%s %s %s", p.Action, p.Type, p.Name)
+	if p.Old != "" {
+		line += fmt.Sprintf(" before=(%s)", p.Old)
+	}
+	if p.New != "" {
+		line += fmt.Sprintf(" after=(%s)", p.New)
+	}
+	return line
+}
+
+// parseCorrection describes c as a change to zone. The fields come from the
+// correction message, like "MODIFY A www.example.com: (1.2.3.4 ttl=100) ->
+// (1.2.3.5 ttl=100)"; a message that doesn't parse keeps only Msg.
+func parseCorrection(zone string, c *models.Correction) plannedChange {
+	p := plannedChange{Zone: zone, Msg: c.Msg}
+	fields := strings.SplitN(c.Msg, " ", 4)
+	if len(fields) >= 3 {
+		p.Action, p.Type, p.Name = fields[0], fields[1], strings.TrimSuffix(fields[2], ":")
+	}
+	if len(fields) == 4 {
+		switch p.Action {
+		case "CREATE":
+			p.New = fields[3]
+		case "DELETE":
+			p.Old = fields[3]
+		case "MODIFY":
+			if parts := strings.SplitN(fields[3], " -> ", 2); len(parts) == 2 {
+				p.Old = strings.Trim(parts[0], "()")
+				p.New = strings.Trim(parts[1], "()")
+			}
+		}
+	}
+	return p
+}
+
+func writePlan() error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(planned)
+}
@@ -0,0 +1,100 @@
+package dnssync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/digitalocean/godo"
+)
+
+// ruleName names a rule in reports by its id, or its name template.
+func ruleName(r *NameRule) string {
+	if r.ID != "" {
+		return r.ID
+	}
+	return "'" + r.Type + " " + r.FQDN + "'"
+}
+
+// accountDomains lists the names of the domains in the DigitalOcean account.
+func accountDomains(ctx context.Context, client *godo.Client) (map[string]bool, error) {
+	names := map[string]bool{}
+	opt := &godo.ListOptions{}
+	for {
+		domains, resp, err := client.Domains.List(ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range domains {
+			names[d.Name] = true
+		}
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opt.Page = page + 1
+	}
+	return names, nil
+}
+
+// Preflight computes the desired state from the live account, read only,
+// and reports zones missing from the account, rules that produce nothing
+// and names produced by more than one rule.
+func Preflight(ctx context.Context, c Config) error {
+	if err := configure(c); err != nil {
+		return err
+	}
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	rules, err := LoadRules(ctx)
+	if err != nil {
+		return err
+	}
+	nameMap, err := LoadNameMap()
+	if err != nil {
+		return err
+	}
+	rules = supportedRules(enabledRules(rules))
+	insts, err := listInstances(ctx, client, rules)
+	if err != nil {
+		return err
+	}
+	if insts, err = filterInstances(ctx, insts); err != nil {
+		return err
+	}
+	domains, skips, err := desiredState(ctx, client, rules, bySource(insts), nameMap)
+	if err != nil {
+		return err
+	}
+	skips.log()
+	existing, err := accountDomains(ctx, client)
+	if err != nil {
+		return err
+	}
+	problems := 0
+	for _, dc := range sortedZones(domains) {
+		if zoneProvider(dc) == "digitalocean" && !existing[dc.Name] {
+			fmt.Printf("Zone %s has %d records but doesn't exist in the account\n", dc.Name, len(dc.Records))
+			problems++
+		}
+	}
+	for _, rule := range rules {
+		if skips.produced[rule] == 0 && rule.Fallback == "" {
+			fmt.Printf("Rule %s produces no records for any of the %d instances of %s\n", ruleName(rule), len(bySource(insts)[rule.source()]), rule.source())
+			problems++
+		}
+	}
+	for _, c := range skips.conflicts {
+		fmt.Println(c)
+		problems++
+	}
+	if problems > 0 {
+		return fmt.Errorf("Preflight found %d problems", problems)
+	}
+	fmt.Printf("Preflight OK: %d rules, %d droplets, %d zones\n", len(rules), len(bySource(insts)[sourceDroplets]), len(domains))
+	return nil
+}
@@ -0,0 +1,141 @@
+package dnssync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/digitalocean/godo"
+)
+
+// DigitalOcean has no reverse DNS records of its own: a droplet's addresses
+// resolve back to its name when that is a fully qualified domain name. So
+// the records of ptr rules are made reverse resolvable by renaming their
+// droplets, and the next sync recovers the $DROP a renamed droplet had from
+// the rule's name. Floating IPs can't be given reverse DNS at all.
+
+// checkPTRRule checks that the ptr option of rule can be honored.
+func checkPTRRule(rule *NameRule) error {
+	if rule.Type != "A" && rule.Type != "AAAA" {
+		return fmt.Errorf("The ptr option is only valid on A and AAAA rules, not %s", rule.Type)
+	}
+	if rule.source() != sourceDroplets {
+		return fmt.Errorf("The ptr option only works for droplets, not %s", rule.source())
+	}
+	fqdn := rule.FQDN
+	if strings.Contains(fqdn, ",") || strings.Count(fqdn, "$") != 1 || !strings.Contains(fqdn, "$DROP") || strings.Contains(fqdn, "$DROPIP") {
+		return fmt.Errorf("The ptr option needs a single name using $DROP and no other variable, not '%s'", fqdn)
+	}
+	return nil
+}
+
+// ptrAffixes returns the parts of a ptr rule's name before and after $DROP.
+func ptrAffixes(rule *NameRule) (string, string) {
+	fqdn := strings.ToLower(strings.TrimSuffix(rule.FQDN, "."))
+	i := strings.Index(fqdn, "$drop")
+	return fqdn[:i], fqdn[i+len("$drop"):]
+}
+
+// ptrShortNames gives the droplets of drops that a ptr rule renamed the
+// name they had before, as "web1" for web1.ssdv.win under
+// "A $DROP.ssdv.win $PUB4 ptr", so every rule's records, names and
+// matches stay what they were before the rename. It returns a copy of
+// drops with the short names, and the names the droplets really have, by
+// ID.
+func ptrShortNames(rules []*NameRule, drops []Instance) ([]Instance, map[int]string) {
+	names := map[int]string{}
+	drops = append([]Instance(nil), drops...)
+	for i, drop := range drops {
+		names[drop.ID] = drop.Name
+		name := strings.ToLower(drop.Name)
+		for _, rule := range rules {
+			if !rule.PTR {
+				continue
+			}
+			prefix, suffix := ptrAffixes(rule)
+			if len(name) > len(prefix)+len(suffix) && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) {
+				if short := name[len(prefix) : len(name)-len(suffix)]; !strings.Contains(short, ".") {
+					drops[i].Name = short
+					break
+				}
+			}
+		}
+	}
+	return drops, names
+}
+
+// ptrRenameDroplets opts in to ptr rules renaming droplets. This tool
+// otherwise never changes a droplet, so without it the renames ptr rules
+// call for are only reported.
+var ptrRenameDroplets = os.Getenv("PTR_RENAME_DROPLETS") != ""
+
+// ptrRename is a droplet whose name should change for reverse DNS.
+type ptrRename struct {
+	ID       int
+	From, To string
+}
+
+// pendingRenames holds the renames the last desiredState found, by droplet
+// ID.
+var pendingRenames = map[int]ptrRename{}
+
+// applyRenames renames the droplets in pendingRenames under
+// PTR_RENAME_DROPLETS, gated like record changes: a rename replaces the
+// droplet's name, so it's only reported when planning, skipped under
+// NO_DELETE and asked about in interactive mode.
+func applyRenames(ctx context.Context, client *godo.Client) error {
+	ids := make([]int, 0, len(pendingRenames))
+	for id := range pendingRenames {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	if len(ids) == 0 {
+		return nil
+	}
+	switch {
+	case planning():
+		for _, id := range ids {
+			r := pendingRenames[id]
+			slog.Info("[DRY-RUN] Would rename droplet for reverse DNS", "droplet", r.From, "to", r.To)
+		}
+		return nil
+	case !ptrRenameDroplets:
+		for _, id := range ids {
+			r := pendingRenames[id]
+			slog.Info("Not renaming droplet for reverse DNS without PTR_RENAME_DROPLETS", "droplet", r.From, "to", r.To)
+		}
+		return nil
+	case noDelete && !cfg.Reconcile:
+		for _, id := range ids {
+			r := pendingRenames[id]
+			slog.Warn("Skipping droplet rename for reverse DNS under NO_DELETE", "droplet", r.From, "to", r.To)
+		}
+		return nil
+	case cfg.Interactive:
+		lines := make([]string, 0, len(ids))
+		for _, id := range ids {
+			r := pendingRenames[id]
+			lines = append(lines, "rename "+r.From+" to "+r.To)
+		}
+		if !ask("Droplets to rename for reverse DNS:", lines) {
+			return nil
+		}
+	}
+	for _, id := range ids {
+		r := pendingRenames[id]
+		// A rename that failed with a server error may have gone through,
+		// so only a rate limit is retried.
+		err := retryIf(ctx, "renaming droplet "+r.From, rateLimited, func() error {
+			_, _, err := client.DropletActions.Rename(ctx, id, r.To)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Renaming droplet %s to %s: %w", r.From, r.To, err)
+		}
+		slog.Info("Renamed droplet for reverse DNS", "droplet", r.From, "to", r.To)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package dnssync
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/godo"
+)
+
+func TestPTRShortNameForEveryRule(t *testing.T) {
+	rules, _, err := parseRules("t.cfg", []byte("A $DROP.ssdv.win $PUB4 ptr\nA $DROP.example.com $PUB4\nA $DROP.pvt.ssdv.win $PUB4 name=web1\nA re-$1.ssdv.win $PUB4 `^(web\\d+)$`\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drop := godo.Droplet{ID: 1, Name: "web1.ssdv.win", Networks: &godo.Networks{V4: []godo.NetworkV4{{IPAddress: "1.2.3.4", Type: "public"}}}}
+	insts := map[string][]Instance{sourceDroplets: {{Droplet: drop, Source: sourceDroplets}}}
+	domains, _, err := desiredState(context.Background(), nil, rules, insts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := insts[sourceDroplets][0].Name; name != "web1.ssdv.win" {
+		t.Errorf("desiredState renamed the caller's droplet to %s", name)
+	}
+	var names []string
+	for _, dc := range domains {
+		for _, rec := range dc.Records {
+			names = append(names, rec.NameFQDN)
+		}
+	}
+	sort.Strings(names)
+	// Every rule sees the name the droplet had before its ptr rename.
+	want := []string{"re-web1.ssdv.win", "web1.example.com", "web1.pvt.ssdv.win", "web1.ssdv.win"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("got records %v, want %v", names, want)
+	}
+	if len(pendingRenames) != 0 {
+		t.Errorf("got renames %v for a droplet already named for its ptr rule", pendingRenames)
+	}
+}
+
+func TestApplyRenamesGated(t *testing.T) {
+	defer func(nd, opt bool, c Config, p map[int]ptrRename) {
+		noDelete, ptrRenameDroplets, cfg, pendingRenames = nd, opt, c, p
+	}(noDelete, ptrRenameDroplets, cfg, pendingRenames)
+	pendingRenames = map[int]ptrRename{1: {ID: 1, From: "web1", To: "web1.ssdv.win"}}
+	// A nil client panics if a rename is attempted.
+	noDelete, ptrRenameDroplets, cfg = false, false, Config{}
+	if err := applyRenames(context.Background(), nil); err != nil {
+		t.Errorf("without PTR_RENAME_DROPLETS: %s", err)
+	}
+	ptrRenameDroplets = true
+	noDelete, cfg = true, Config{}
+	if err := applyRenames(context.Background(), nil); err != nil {
+		t.Errorf("NO_DELETE: %s", err)
+	}
+	noDelete, cfg = false, Config{DryRun: true}
+	if err := applyRenames(context.Background(), nil); err != nil {
+		t.Errorf("dry run: %s", err)
+	}
+}
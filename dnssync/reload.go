@@ -0,0 +1,45 @@
+package dnssync
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often Run checks whether a local names config
+// changed, to sync with it right away. Zero disables the check, leaving
+// changes to be picked up by the next sync or a SIGHUP.
+var configPollInterval = envDuration("CONFIG_POLL_INTERVAL", 5*time.Second)
+
+// watchConfig triggers a sync, which reloads the config, on SIGHUP and when
+// the local config file changes, until ctx is done.
+func watchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if configPollInterval > 0 && !isURL(namesCfg) {
+		t := time.NewTicker(configPollInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	mod := configModTime()
+	for {
+		select {
+		case <-hup:
+			slog.Info("Reloading on SIGHUP", "config", namesCfg)
+			TriggerSync()
+		case <-tick:
+			if m := configModTime(); !m.Equal(mod) {
+				mod = m
+				slog.Info("Config changed, reloading", "config", namesCfg)
+				TriggerSync()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package dnssync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+// reportOutput is where the per-zone change report goes, separate from the
+// log: "stdout" (the default), "stderr", or a file to append to.
+var reportOutput = envOr("REPORT_OUTPUT", "stdout")
+
+// report receives the change report: zone headers and each correction.
+var report io.Writer = os.Stdout
+
+// reportJSON sends the change report through slog instead of to report,
+// one structured entry per line, so that under LOG_FORMAT=json the output
+// is all JSON. It's set unless Config.Report names a writer.
+var reportJSON bool
+
+// logFormat is LOG_FORMAT, which the command checks when it sets up
+// logging.
+var logFormat = envOr("LOG_FORMAT", "text")
+
+// reportVerbosity is how much of the change report is written: "errors"
+// for failed corrections only, "changes" (the default) for corrections that
+// were applied or withheld too, and "all" for every zone's header, unchanged
+// zones and informational corrections as well.
+var reportVerbosity = envOr("REPORT_VERBOSITY", "changes")
+
+// Verbosity levels of report lines.
+const (
+	reportErrors = iota
+	reportChanges
+	reportAll
+)
+
+var reportLevels = map[string]int{"errors": reportErrors, "changes": reportChanges, "all": reportAll}
+
+var (
+	reportMu sync.Mutex
+	// headedZone is the zone whose header was written last. A zone's header
+	// is written before its first report line, so zones with nothing to
+	// report get no header, and again whenever the lines of zones synced
+	// at once alternate.
+	headedZone string
+)
+
+// reportHeader starts the report for zone.
+func reportHeader(zone string) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	if headedZone == zone {
+		// Left over from the previous sync.
+		headedZone = ""
+	}
+	if reportLevels[reportVerbosity] >= reportAll && !reportJSON {
+		fmt.Fprintln(report, "-----", zone)
+		headedZone = zone
+	}
+}
+
+// reportln writes a line about zone to the report if the verbosity
+// includes level.
+func reportln(zone string, level int, args ...interface{}) {
+	if level > reportLevels[reportVerbosity] {
+		return
+	}
+	if reportJSON {
+		slog.Log(context.Background(), reportLevel(level), strings.TrimSuffix(fmt.Sprintln(args...), "\n"), "zone", zone)
+		return
+	}
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	if headedZone != zone {
+		fmt.Fprintln(report, "-----", zone)
+		headedZone = zone
+	}
+	fmt.Fprintln(report, args...)
+}
+
+// reportChange reports what became of correction c to dc: line in the text
+// report, or a structured entry with status, like "SKIPPED (NO_DELETE)",
+// split into its status and reason, the parsed change, the rules and
+// droplets behind it, and err.
+func reportChange(dc *models.DomainConfig, level int, status string, c *models.Correction, err error, line ...interface{}) {
+	if !reportJSON {
+		reportln(dc.Name, level, line...)
+		return
+	}
+	if level > reportLevels[reportVerbosity] {
+		return
+	}
+	attrs := []interface{}{"zone", dc.Name}
+	if i := strings.Index(status, " ("); i >= 0 {
+		attrs = append(attrs, "status", status[:i], "reason", strings.Trim(status[i+2:], ")"))
+	} else {
+		attrs = append(attrs, "status", status)
+	}
+	p := parseCorrection(dc.Name, c)
+	if p.Action == "" {
+		attrs = append(attrs, "correction", c.Msg)
+	} else {
+		attrs = append(attrs, "action", p.Action, "type", p.Type, "name", p.Name)
+	}
+	if p.Old != "" {
+		attrs = append(attrs, "old", p.Old)
+	}
+	if p.New != "" {
+		attrs = append(attrs, "new", p.New)
+	}
+	rules, drops := correctionSources(dc, c)
+	if len(rules) > 0 {
+		attrs = append(attrs, "rule", strings.Join(rules, ","))
+	}
+	if len(drops) > 0 {
+		attrs = append(attrs, "droplet", strings.Join(drops, ","))
+	}
+	if err != nil {
+		attrs = append(attrs, "error", err.Error())
+	}
+	slog.Log(context.Background(), reportLevel(level), "DNS change", attrs...)
+}
+
+// reportLevel is the log level of report lines of the given verbosity.
+func reportLevel(level int) slog.Level {
+	if level == reportErrors {
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+var (
+	reportOnce sync.Once
+	outputW    io.Writer
+	outputErr  error
+)
+
+// reportOutputWriter returns the writer REPORT_OUTPUT names, opening it on
+// first use.
+func reportOutputWriter() (io.Writer, error) {
+	reportOnce.Do(func() {
+		switch reportOutput {
+		case "stdout", "-":
+			outputW = os.Stdout
+		case "stderr":
+			outputW = os.Stderr
+		default:
+			outputW, outputErr = os.OpenFile(reportOutput, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		}
+	})
+	return outputW, outputErr
+}
@@ -0,0 +1,49 @@
+package dnssync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+func TestReportJSON(t *testing.T) {
+	defer func(j bool, l *slog.Logger) { reportJSON = j; slog.SetDefault(l) }(reportJSON, slog.Default())
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	reportJSON = true
+	dc := &models.DomainConfig{Name: "ssdv.win"}
+	reportHeader(dc.Name)
+	reportChange(dc, reportChanges, "SKIPPED (NO_DELETE)", &models.Correction{Msg: "DELETE A web.ssdv.win 1.2.3.4 ttl=100"}, nil, "SKIPPED (NO_DELETE)", "DELETE A web.ssdv.win 1.2.3.4 ttl=100")
+	reportChange(dc, reportErrors, "FAILED", &models.Correction{Msg: "CREATE A app.ssdv.win 1.2.3.5 ttl=100"}, errors.New("boom"))
+	reportln(dc.Name, reportChanges, "Skipping", dc.Name)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3:\n%s", len(lines), buf.String())
+	}
+	var entries []map[string]interface{}
+	for _, line := range lines {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("line isn't JSON: %s: %s", line, err)
+		}
+		entries = append(entries, e)
+	}
+	want := []map[string]interface{}{
+		{"level": "INFO", "zone": "ssdv.win", "status": "SKIPPED", "reason": "NO_DELETE", "action": "DELETE", "type": "A", "name": "web.ssdv.win", "old": "1.2.3.4 ttl=100"},
+		{"level": "ERROR", "zone": "ssdv.win", "status": "FAILED", "action": "CREATE", "new": "1.2.3.5 ttl=100", "error": "boom"},
+		{"level": "INFO", "zone": "ssdv.win", "msg": "Skipping ssdv.win"},
+	}
+	for i, w := range want {
+		for k, v := range w {
+			if entries[i][k] != v {
+				t.Errorf("entry %d: %s = %v, want %v", i, k, entries[i][k], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,1153 @@
+package dnssync
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type NameRule struct {
+	Type     string
+	FQDN     string
+	Target   string
+	Port     int
+	Label    string
+	Regex    *regexp.Regexp
+	Provider string
+	Service  string
+	Proto    string
+	// VPC selects $PRI4 from the droplet's address in this VPC.
+	VPC string
+	// PublicCIDR selects $PUB4 from the droplet's public addresses in it.
+	PublicCIDR *net.IPNet
+	// Disabled rules are parsed but produce no records.
+	Disabled bool
+	// ID names the rule in log messages about the records it produces.
+	ID string
+	// DropletName limits the rule to the droplet with exactly this name.
+	DropletName string
+	// Region limits the rule to droplets in this region slug.
+	Region string
+	// Feature limits the rule to droplets with this feature, like ipv6.
+	Feature string
+	// Project limits the rule to droplets in the project with this name or ID.
+	Project string
+	// Source names the Source of the instances the rule applies to, the
+	// droplet list unless the rule gives source=.
+	Source string
+	// MetaURL is fetched for each droplet, after expanding its variables,
+	// to give $META.
+	MetaURL string
+	// Zone, when set, is used instead of deriving the zone from the name.
+	Zone string
+	// TTL of generated records, globalTTL unless the rule gives ttl=.
+	TTL uint32
+	// TTLSet is true when the rule gave its own ttl=, which then takes
+	// precedence over its zone's default.
+	TTLSet      bool
+	SrvWeight   uint16
+	SrvPriority uint16
+	// MxPreference is an MX rule's preference, given after its target or
+	// as priority=.
+	MxPreference uint16
+	// WeightFrom, when set, derives each droplet's SRV weight from its
+	// "vcpus", its "memory" in GB, or the number after a tag prefix given as
+	// "tag:prefix". Droplets without a value get SrvWeight.
+	WeightFrom string
+	// PrivateLabel, from private=pvt, is inserted between a record's name
+	// and its zone, so www.example.com becomes www.pvt.example.com. Setting
+	// it on a rule adds a twin rule with this set and the targets' public
+	// addresses swapped for private ones.
+	PrivateLabel string
+	// Fallback is the id of a rule this one stands in for: it only produces
+	// records, from literal names and targets, in a sync where that rule
+	// produced none, like a maintenance page for an empty fleet.
+	Fallback string
+	// Meta is copied into the metadata of each record, from meta:key=value
+	// options, for providers that read extra per-record settings.
+	Meta map[string]string
+	// TagRegex limits the rule to droplets whose key:value tag for each key
+	// matches its regex, from tag:key=`regex` options. The groups are
+	// $TAG:key:1, $TAG:key:2, ... and $TAG:key:name.
+	TagRegex map[string]*regexp.Regexp
+	// Depends lists the ids of rules whose records are applied before this
+	// rule's, from depends=a,b. Within a zone, each depth of dependencies is
+	// applied in full before the next starts, whatever
+	// MAX_APPLY_CONCURRENCY is. Zones are synced independently, so there is
+	// no ordering between records in different zones, or in the same zone
+	// served by different providers, when ZONE_CONCURRENCY is above 1.
+	Depends []string
+	// Flatten, set by the flatten option, turns the records of a CNAME rule
+	// into A and AAAA records for its target's current addresses, for names
+	// like a zone's apex that can't be CNAMEs.
+	Flatten bool
+	// PTR, set by the ptr option, renames each droplet an A or AAAA rule
+	// matches to the name of its record, which is how DigitalOcean sets the
+	// reverse DNS of a droplet's addresses. Renames only happen under
+	// PTR_RENAME_DROPLETS.
+	PTR bool
+	// Aggregate, set by the aggregate option, makes the records the rule
+	// produces under one name a single record set, like web.example.com
+	// with an A record for every droplet tagged web: droplets with the same
+	// target share a record, and the set gets the lowest TTL among them.
+	Aggregate bool
+}
+
+func enabledRules(rules []*NameRule) []*NameRule {
+	enabled := []*NameRule{}
+	for _, rule := range rules {
+		if !rule.Disabled {
+			enabled = append(enabled, rule)
+		}
+	}
+	return enabled
+}
+
+// onlyFilter describes the OnlyRule and OnlyTag filter in effect, or is ""
+// when every rule is synced.
+func onlyFilter() string {
+	var f []string
+	if cfg.OnlyRule != "" {
+		f = append(f, "id "+cfg.OnlyRule)
+	}
+	if cfg.OnlyTag != "" {
+		f = append(f, "tag "+cfg.OnlyTag)
+	}
+	return strings.Join(f, " and ")
+}
+
+// hasLabelTag reports whether tag is one of the tags rule's label requires.
+func hasLabelTag(rule *NameRule, tag string) bool {
+	for _, t := range strings.Split(rule.Label, ",") {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyRules returns the rules selected by OnlyRule and OnlyTag.
+func onlyRules(rules []*NameRule) []*NameRule {
+	selected := []*NameRule{}
+	for _, rule := range rules {
+		if cfg.OnlyRule != "" && rule.ID != cfg.OnlyRule {
+			continue
+		}
+		if cfg.OnlyTag != "" && !hasLabelTag(rule, cfg.OnlyTag) {
+			continue
+		}
+		selected = append(selected, rule)
+	}
+	return selected
+}
+
+// logf logs a message about this rule at level, tagged with its id if it
+// has one.
+func (r *NameRule) logf(level slog.Level, format string, args ...interface{}) {
+	var attrs []interface{}
+	if r.ID != "" {
+		attrs = append(attrs, "rule", r.ID)
+	}
+	slog.Log(context.Background(), level, fmt.Sprintf(format, args...), attrs...)
+}
+
+// source returns the name of the rule's Source.
+func (r *NameRule) source() string {
+	if r.Source == "" {
+		return sourceDroplets
+	}
+	return r.Source
+}
+
+// Targets returns the rule's target templates. A rule may list several,
+// separated by commas, and gets one record per target. A TXT rule's value
+// is a single target, commas and all.
+func (r *NameRule) Targets() []string {
+	if r.Type == "TXT" {
+		return []string{r.Target}
+	}
+	return strings.Split(r.Target, ",")
+}
+
+// Names returns the rule's name templates, each prefixed with
+// _service._proto. when those were given separately. A rule may list
+// several names, separated by commas, and each gets the same targets.
+func (r *NameRule) Names() []string {
+	names := strings.Split(r.FQDN, ",")
+	if r.Service != "" {
+		for i, n := range names {
+			names[i] = "_" + r.Service + "._" + r.Proto + "." + n
+		}
+	}
+	return names
+}
+
+// namesCfg is the path or http(s) URL the rules are loaded from.
+var namesCfg = envOr("NAMES_CFG", "names.cfg")
+
+var lastGoodRules []*NameRule
+
+// defaultRules is the config built into the binary, used when namesCfg is a
+// local file that doesn't exist.
+//
+//go:embed default.cfg
+var defaultRules []byte
+
+// zoneSettings holds the per-zone settings from a config's zone lines.
+type zoneSettings struct {
+	// TTLs are default TTLs from "zone example.com ttl=300" lines, used for
+	// records whose rule has no ttl= of its own.
+	TTLs map[string]uint32
+	// Allowed, when a "zones" line gave it, is the only zones records may be
+	// synced to.
+	Allowed map[string]bool
+	// AppendOnly zones, from "zone example.com policy=append-only" lines,
+	// never have records deleted, so they can hold manual records too.
+	AppendOnly map[string]bool
+	// Manage, from "zone example.com manage-regex=`^web-`" lines, limits
+	// the records of a zone this tool owns to those whose names match.
+	// Others are never deleted, so the zone can be shared with records
+	// managed by hand.
+	Manage map[string]*regexp.Regexp
+	// Excluded, from "exclude [ci]" or "exclude `^runner-`" lines, are the
+	// droplets no rule produces records for, like short-lived CI runners.
+	Excluded []dropletFilter
+	// Ignored, from "ignore vpn.ssdv.win *.manual.ssdv.win" lines, are names,
+	// or globs of names, left out of syncing entirely: no records are
+	// produced for them and their records are never changed or deleted.
+	// Globs follow path.Match, so * crosses dots: *.manual.ssdv.win covers
+	// every name under manual.ssdv.win, however deep.
+	Ignored []string
+	// Sync holds the sync options of a JSON config's "sync" object.
+	Sync syncSettings
+}
+
+// zoneAllowed reports whether records may be synced to zone.
+func (z *zoneSettings) zoneAllowed(zone string) bool {
+	return z.Allowed == nil || z.Allowed[zone]
+}
+
+func newZoneSettings() *zoneSettings {
+	return &zoneSettings{TTLs: map[string]uint32{}, AppendOnly: map[string]bool{}, Manage: map[string]*regexp.Regexp{}}
+}
+
+var zoneCfg = newZoneSettings()
+
+// LoadRules loads the rules and zone settings of namesCfg. When it can't be
+// read or is invalid after having loaded before, the last known good rules
+// are kept and a sync goes ahead with them.
+func LoadRules(ctx context.Context) ([]*NameRule, error) {
+	rules, zones, err := readRules(ctx)
+	if err != nil {
+		configLoaded.Set(0)
+		if lastGoodRules == nil {
+			return nil, err
+		}
+		slog.Error("Error loading config, using the last known good rules", "config", namesCfg, "error", err)
+		zoneCfg.Sync.apply(&cfg)
+		return lastGoodRules, nil
+	}
+	configLoaded.Set(1)
+	configLoadedAt.SetToCurrentTime()
+	lastGoodRules, zoneCfg = rules, zones
+	zoneCfg.Sync.apply(&cfg)
+	return rules, nil
+}
+
+// readRules reads and parses namesCfg, with its includes and overlay.
+func readRules(ctx context.Context) ([]*NameRule, *zoneSettings, error) {
+	name := namesCfg
+	var dat []byte
+	var err error
+	if isURL(namesCfg) {
+		dat, err = fetchConfig(ctx, namesCfg)
+	} else if dat, err = ioutil.ReadFile(namesCfg); os.IsNotExist(err) {
+		slog.Warn("Config not found, using the built in rules", "config", namesCfg)
+		name, dat, err = "default.cfg", defaultRules, nil
+	}
+	if err == nil && !strings.HasSuffix(name, ".json") {
+		stack := []string{namesCfg}
+		if !isURL(namesCfg) {
+			stack = []string{filepath.Clean(namesCfg)}
+		}
+		dat, err = expandIncludes(ctx, namesCfg, dat, stack)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	rules, zones, err := parseRules(name, dat)
+	if err == nil {
+		rules, zones, err = applyOverlay(ctx, rules, zones)
+	}
+	return rules, zones, err
+}
+
+// namesOverlay is an optional path or URL of a config layered over namesCfg,
+// for per-environment tweaks. Its rules replace the base rules with the same
+// id; the rest are added. Its zone settings override the base's.
+var namesOverlay = os.Getenv("NAMES_OVERLAY")
+
+// applyOverlay merges namesOverlay into the base rules and zone settings,
+// then checks the @id references of the result.
+func applyOverlay(ctx context.Context, rules []*NameRule, zones *zoneSettings) ([]*NameRule, *zoneSettings, error) {
+	if namesOverlay != "" {
+		var dat []byte
+		var err error
+		if isURL(namesOverlay) {
+			dat, err = fetchConfig(ctx, namesOverlay)
+		} else {
+			dat, err = ioutil.ReadFile(namesOverlay)
+		}
+		if err == nil && !strings.HasSuffix(namesOverlay, ".json") {
+			dat, err = expandIncludes(ctx, namesOverlay, dat, []string{filepath.Clean(namesOverlay)})
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		overlay, overlayZones, err := parseRules(namesOverlay, dat)
+		if err != nil {
+			return nil, nil, err
+		}
+		byID := map[string]int{}
+		for i, rule := range rules {
+			if rule.ID != "" {
+				byID[rule.ID] = i
+			}
+		}
+		for _, rule := range overlay {
+			if i, ok := byID[rule.ID]; ok && rule.ID != "" {
+				rules[i] = rule
+			} else {
+				rules = append(rules, rule)
+			}
+		}
+		for zone, ttl := range overlayZones.TTLs {
+			zones.TTLs[zone] = ttl
+		}
+		for zone, appendOnly := range overlayZones.AppendOnly {
+			zones.AppendOnly[zone] = appendOnly
+		}
+		for zone, re := range overlayZones.Manage {
+			zones.Manage[zone] = re
+		}
+		zones.Excluded = append(zones.Excluded, overlayZones.Excluded...)
+		zones.Ignored = append(zones.Ignored, overlayZones.Ignored...)
+		if overlayZones.Allowed != nil {
+			zones.Allowed = overlayZones.Allowed
+		}
+		if overlayZones.Sync != (syncSettings{}) {
+			zones.Sync = overlayZones.Sync
+		}
+	}
+	return rules, zones, checkReferences(rules)
+}
+
+// expandIncludes replaces each "include other.cfg" line in dat, read from
+// src, with the contents of that file, recursively. Relative paths and URLs
+// resolve against src. stack holds the files being expanded, to catch
+// cycles. Included contents are wrapped in includeBegin and includeEnd
+// lines.
+func expandIncludes(ctx context.Context, src string, dat []byte, stack []string) ([]byte, error) {
+	out := &bytes.Buffer{}
+	for _, line := range strings.Split(string(dat), "\n") {
+		target := strings.TrimPrefix(strings.TrimSpace(line), "include ")
+		if target == strings.TrimSpace(line) {
+			out.WriteString(line + "\n")
+			continue
+		}
+		target, err := resolveInclude(src, strings.TrimSpace(target))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range stack {
+			if s == target {
+				return nil, fmt.Errorf("Include cycle: %s -> %s", strings.Join(stack, " -> "), target)
+			}
+		}
+		var inc []byte
+		if isURL(target) {
+			inc, err = fetchConfig(ctx, target)
+		} else {
+			inc, err = ioutil.ReadFile(target)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Including %s from %s: %w", target, src, err)
+		}
+		inc, err = expandIncludes(ctx, target, inc, append(stack[:len(stack):len(stack)], target))
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString(includeBegin + target + "\n")
+		out.Write(inc)
+		out.WriteString(includeEnd + "\n")
+	}
+	return out.Bytes(), nil
+}
+
+// resolveInclude resolves an included path or URL against the file or URL
+// including it.
+func resolveInclude(src, target string) (string, error) {
+	if isURL(src) {
+		base, err := url.Parse(src)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(target)
+		if err != nil {
+			return "", fmt.Errorf("Bad include '%s': %s", target, err)
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+	if isURL(target) || filepath.IsAbs(target) {
+		return target, nil
+	}
+	return filepath.Join(filepath.Dir(src), target), nil
+}
+
+// configModTime returns the modification time of a local config file, or
+// the zero time for URLs and files that can't be read.
+func configModTime() time.Time {
+	if isURL(namesCfg) {
+		return time.Time{}
+	}
+	fi, err := os.Stat(namesCfg)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// namesMap is an optional file of literal "dropletName fqdn" pairs. Rules
+// reference the mapped name as $MAP and are skipped for unmapped droplets.
+var namesMap = os.Getenv("NAMES_MAP")
+
+func LoadNameMap() (map[string]string, error) {
+	m := map[string]string{}
+	if namesMap == "" {
+		return m, nil
+	}
+	dat, err := ioutil.ReadFile(namesMap)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(dat), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected 'dropletName fqdn'", namesMap, i+1)
+		}
+		m[parts[0]] = strings.TrimSuffix(parts[1], ".")
+	}
+	return m, nil
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func fetchConfig(ctx context.Context, url string) ([]byte, error) {
+	timeout, err := time.ParseDuration(envOr("NAMES_CFG_TIMEOUT", "10s"))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching %s returned %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+var srvProtos = map[string]bool{"_tcp": true, "_udp": true, "_tls": true, "_sctp": true}
+
+// checkSRVName checks that an SRV name follows the _service._proto.name
+// convention with a known protocol.
+func checkSRVName(name string) error {
+	labels := strings.SplitN(name, ".", 3)
+	if len(labels) < 3 || len(labels[0]) < 2 || labels[0][0] != '_' {
+		return fmt.Errorf("SRV name '%s' must look like _service._proto.name", name)
+	}
+	if !srvProtos[strings.ToLower(labels[1])] {
+		return fmt.Errorf("SRV name '%s' has unknown protocol '%s'", name, labels[1])
+	}
+	return nil
+}
+
+// configVersion is the newest names.cfg format this build understands.
+const configVersion = 1
+
+func checkConfigVersion(v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return fmt.Errorf("Bad config version '%s'", v)
+	}
+	if n > configVersion {
+		slog.Warn("Config is newer than this build understands; some rules may be misread", "version", n, "supported", configVersion)
+	}
+	return nil
+}
+
+// setOption applies a key=value option from the end of a rule line.
+func (r *NameRule) setOption(key, value string) error {
+	if k := strings.TrimPrefix(key, "meta:"); k != key && k != "" {
+		if r.Meta == nil {
+			r.Meta = map[string]string{}
+		}
+		r.Meta[k] = value
+		return nil
+	}
+	if k := strings.TrimPrefix(key, "tag:"); k != key && k != "" {
+		rex := strings.Trim(value, "`")
+		if rex == value {
+			return fmt.Errorf("Option '%s' needs a regex in backticks", key)
+		}
+		re, err := regexp.Compile(rex)
+		if err != nil {
+			return err
+		}
+		if r.TagRegex == nil {
+			r.TagRegex = map[string]*regexp.Regexp{}
+		}
+		r.TagRegex[k] = re
+		return nil
+	}
+	var err error
+	switch key {
+	case "provider":
+		if providerFactories[value] == nil {
+			return fmt.Errorf("Unknown provider '%s'", value)
+		}
+		r.Provider = value
+	case "id":
+		r.ID = value
+	case "name":
+		r.DropletName = value
+	case "vpc":
+		r.VPC = value
+	case "pub4cidr":
+		_, cidr, perr := net.ParseCIDR(value)
+		if perr != nil {
+			return fmt.Errorf("Bad pub4cidr '%s': %s", value, perr)
+		}
+		r.PublicCIDR = cidr
+	case "region":
+		r.Region = value
+	case "feature":
+		r.Feature = value
+	case "source":
+		if _, err := newSource(value, nil, ""); err != nil {
+			return err
+		}
+		r.Source = value
+	case "fallback":
+		r.Fallback = value
+	case "depends":
+		r.Depends = strings.Split(value, ",")
+	case "private":
+		if r.Type != "A" && r.Type != "AAAA" {
+			return fmt.Errorf("'private' is only valid on A and AAAA rules")
+		}
+		r.PrivateLabel = strings.Trim(value, ".")
+	case "project":
+		r.Project = value
+	case "meta":
+		if !isURL(value) {
+			return fmt.Errorf("Bad meta URL '%s'", value)
+		}
+		r.MetaURL = value
+	case "zone":
+		r.Zone = canonicalName(value)
+	case "tag":
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern == "" {
+				return fmt.Errorf("Bad tag pattern '%s': empty tag", value)
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("Bad tag pattern '%s': %s", value, err)
+			}
+		}
+		r.Label = value
+	case "ttl":
+		ttl, err := parseTTL(value)
+		if err != nil {
+			return err
+		}
+		r.TTL = ttl
+		r.TTLSet = true
+	case "priority":
+		if r.Type != "SRV" && r.Type != "MX" {
+			return fmt.Errorf("'%s' is only valid on SRV and MX rules", key)
+		}
+		var n uint64
+		n, err = strconv.ParseUint(value, 10, 16)
+		if r.Type == "MX" {
+			r.MxPreference = uint16(n)
+		} else {
+			r.SrvPriority = uint16(n)
+		}
+	case "port", "weight", "service", "proto":
+		if r.Type != "SRV" {
+			return fmt.Errorf("'%s' is only valid on SRV rules", key)
+		}
+		var n uint64
+		switch key {
+		case "port":
+			n, err = strconv.ParseUint(value, 10, 16)
+			r.Port = int(n)
+		case "weight":
+			if value == "vcpus" || value == "memory" || strings.HasPrefix(value, "tag:") {
+				r.WeightFrom = value
+				break
+			}
+			n, err = strconv.ParseUint(value, 10, 16)
+			r.SrvWeight = uint16(n)
+		case "service":
+			r.Service = strings.TrimPrefix(value, "_")
+		case "proto":
+			r.Proto = strings.TrimPrefix(value, "_")
+		}
+	default:
+		return fmt.Errorf("Unknown rule option '%s'", key)
+	}
+	if err != nil {
+		return fmt.Errorf("Bad %s '%s': must be an integer from 0 to 65535", key, value)
+	}
+	return nil
+}
+
+// parseTTL parses the value of a ttl= option, which must be a positive
+// number of seconds.
+func parseTTL(value string) (uint32, error) {
+	ttl, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || ttl == 0 {
+		return 0, fmt.Errorf("Bad ttl '%s': must be a positive integer", value)
+	}
+	return uint32(ttl), nil
+}
+
+// parseZoneLine parses a "zone example.com ttl=300" line setting defaults
+// for every record in a zone.
+func parseZoneLine(parts []string, zones *zoneSettings) error {
+	if len(parts) < 3 {
+		return fmt.Errorf("Zone line needs at least 'zone $ZONE $OPTION=$VALUE'")
+	}
+	zone := canonicalName(parts[1])
+	for _, part := range parts[2:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Unexpected zone option '%s'", part)
+		}
+		switch kv[0] {
+		case "ttl":
+			ttl, err := parseTTL(kv[1])
+			if err != nil {
+				return err
+			}
+			zones.TTLs[zone] = ttl
+		case "policy":
+			if kv[1] != "full" && kv[1] != "append-only" {
+				return fmt.Errorf("Zone policy must be 'full' or 'append-only', not '%s'", kv[1])
+			}
+			zones.AppendOnly[zone] = kv[1] == "append-only"
+		case "manage-regex":
+			re, err := regexp.Compile(strings.Trim(kv[1], "`"))
+			if err != nil {
+				return fmt.Errorf("Bad manage-regex '%s': %s", kv[1], err)
+			}
+			zones.Manage[zone] = re
+		default:
+			return fmt.Errorf("Unexpected zone option '%s'", part)
+		}
+	}
+	return nil
+}
+
+// splitRuleLine splits line into its space-separated parts, keeping a
+// double-quoted part, like the value of a TXT rule, whole with its quotes.
+func splitRuleLine(line string) ([]string, error) {
+	var parts []string
+	quoted := ""
+	for _, part := range strings.Split(line, " ") {
+		if quoted != "" {
+			quoted += " " + part
+			if closesQuote(part) {
+				parts = append(parts, quoted)
+				quoted = ""
+			}
+			continue
+		}
+		if strings.HasPrefix(part, `"`) && !(len(part) > 1 && closesQuote(part)) {
+			quoted = part
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if quoted != "" {
+		return nil, fmt.Errorf("Unterminated quote in '%s'", line)
+	}
+	return parts, nil
+}
+
+// closesQuote reports whether part ends in a double quote that isn't
+// escaped.
+func closesQuote(part string) bool {
+	n := 0
+	for i := len(part) - 2; i >= 0 && part[i] == '\\'; i-- {
+		n++
+	}
+	return strings.HasSuffix(part, `"`) && n%2 == 0
+}
+
+// txtEscapes undoes the escapes of a quoted TXT value.
+var txtEscapes = strings.NewReplacer(`\\`, `\`, `\"`, `"`)
+
+// unquoteTXT returns the value of a TXT rule's target, without the quotes
+// around it if it has them.
+func unquoteTXT(s string) string {
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		return txtEscapes.Replace(s[1 : len(s)-1])
+	}
+	return s
+}
+
+// quoteTXT quotes a TXT value for a config line, the inverse of unquoteTXT.
+func quoteTXT(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// includeBegin and includeEnd mark where expandIncludes put the contents
+// of an included file, so parseRules can report positions in it.
+const (
+	includeBegin = "# begin include "
+	includeEnd   = "# end include"
+)
+
+// parseRules parses the config dat read from name, reporting errors with the
+// file and line they are on.
+func parseRules(name string, dat []byte) ([]*NameRule, *zoneSettings, error) {
+	if strings.HasSuffix(name, ".json") {
+		return parseJSONRules(name, dat)
+	}
+	// TODO: test this harder
+	rules := []*NameRule{}
+	zones := newZoneSettings()
+	type position struct {
+		file string
+		line int
+	}
+	stack := []position{{file: name}}
+	for _, line := range strings.Split(string(dat), "\n") {
+		line = strings.TrimSpace(line)
+		if line == includeEnd && len(stack) > 1 {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		pos := &stack[len(stack)-1]
+		pos.line++
+		if file := strings.TrimPrefix(line, includeBegin); file != line {
+			stack = append(stack, position{file: file})
+			continue
+		}
+		if err := parseRuleLine(line, &rules, zones); err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %w", pos.file, pos.line, err)
+		}
+	}
+	return rules, zones, nil
+}
+
+// parseRuleLine parses one config line, adding the rules it defines to
+// rules and its zone settings to zones.
+func parseRuleLine(line string, rules *[]*NameRule, zones *zoneSettings) error {
+	if v := strings.TrimPrefix(line, "# version:"); v != line {
+		return checkConfigVersion(strings.TrimSpace(v))
+	}
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	parts, err := splitRuleLine(line)
+	if err != nil {
+		return err
+	}
+	if parts[0] == "zone" {
+		return parseZoneLine(parts, zones)
+	}
+	if parts[0] == "exclude" {
+		return parseExcludeLine(parts, zones)
+	}
+	if parts[0] == "ignore" {
+		return parseIgnoreLine(parts, zones)
+	}
+	if parts[0] == "zones" {
+		if zones.Allowed == nil {
+			zones.Allowed = map[string]bool{}
+		}
+		for _, zone := range parts[1:] {
+			zones.Allowed[canonicalName(zone)] = true
+		}
+		return nil
+	}
+	if len(parts) < 3 {
+		return fmt.Errorf("Each name rule needs at least '$TYPE $FQDN $TARGET")
+	}
+	rule, err := newRule(parts[0], parts[1], parts[2])
+	if err != nil {
+		return err
+	}
+	parts = parts[3:]
+	if rule.Type == "SRV" && len(parts) > 0 {
+		if port, err := strconv.Atoi(parts[0]); err == nil {
+			rule.Port = port
+			parts = parts[1:]
+		}
+	}
+	if rule.Type == "MX" && len(parts) > 0 {
+		if pref, err := strconv.ParseUint(parts[0], 10, 16); err == nil {
+			rule.MxPreference = uint16(pref)
+			parts = parts[1:]
+		}
+	}
+	for _, part := range parts {
+		if label := strings.TrimSuffix(strings.TrimPrefix(part, "["), "]"); label != part {
+			if err := rule.setOption("tag", label); err != nil {
+				return err
+			}
+		} else if kv := strings.SplitN(part, "=", 2); len(kv) == 2 && strings.HasPrefix(kv[0], "tag:") {
+			if err := rule.setOption(kv[0], kv[1]); err != nil {
+				return err
+			}
+		} else if rex := strings.Trim(part, "`"); rex != part {
+			rule.Regex, err = regexp.Compile(rex)
+			if err != nil {
+				return err
+			}
+		} else if kv := strings.SplitN(part, "=", 2); len(kv) == 2 {
+			if err := rule.setOption(kv[0], kv[1]); err != nil {
+				return err
+			}
+		} else if part == "disabled" {
+			rule.Disabled = true
+		} else if part == "flatten" {
+			rule.Flatten = true
+		} else if part == "ptr" {
+			rule.PTR = true
+		} else if part == "aggregate" {
+			rule.Aggregate = true
+		} else {
+			return fmt.Errorf("Unexpected rule part '%s'", part)
+		}
+	}
+	return addRule(rules, rule)
+}
+
+// newRule returns a rule of type typ, prefixed with ! when disabled, with
+// the default options.
+func newRule(typ, fqdn, target string) (*NameRule, error) {
+	rule := &NameRule{
+		Type:         typ,
+		FQDN:         fqdn,
+		Target:       target,
+		Provider:     defaultProvider,
+		TTL:          globalTTL(),
+		SrvWeight:    10,
+		SrvPriority:  10,
+		MxPreference: 10,
+	}
+	if strings.HasPrefix(rule.Type, "!") {
+		rule.Type = rule.Type[1:]
+		rule.Disabled = true
+	}
+	switch rule.Type {
+	case "A", "AAAA", "SRV":
+	case "CNAME", "MX":
+		if !strings.HasPrefix(rule.Target, "@") && !strings.HasSuffix(rule.Target, ".") {
+			return nil, fmt.Errorf("%s target '%s' must be a fully qualified name ending in a dot", rule.Type, rule.Target)
+		}
+	case "TXT":
+		rule.Target = unquoteTXT(rule.Target)
+	default:
+		return nil, fmt.Errorf("Unknown rule record type '%s'", rule.Type)
+	}
+	return rule, nil
+}
+
+// addRule checks rule, with all its options set, and adds it to rules,
+// along with its private twin if it has one.
+func addRule(rules *[]*NameRule, rule *NameRule) error {
+	if rule.Type == "SRV" && rule.Port == 0 {
+		return fmt.Errorf("SRV rule needs at least '$TYPE $FQDN $TARGET $PORT', or a port= option")
+	}
+	if rule.Flatten && rule.Type != "CNAME" {
+		return fmt.Errorf("The flatten option is only valid on CNAME rules, not %s", rule.Type)
+	}
+	if rule.PTR {
+		if err := checkPTRRule(rule); err != nil {
+			return err
+		}
+	}
+	if err := checkModifiers(rule.FQDN + " " + rule.Target); err != nil {
+		return err
+	}
+	if rule.Aggregate && rule.Type == "CNAME" && !rule.Flatten {
+		return fmt.Errorf("The aggregate option can't be used on CNAME rules, which have a single target, unless they flatten")
+	}
+	if (rule.Service == "") != (rule.Proto == "") {
+		return fmt.Errorf("SRV rule needs both service= and proto= when either is given")
+	}
+	if rule.Type == "SRV" {
+		for _, name := range rule.Names() {
+			if err := checkSRVName(name); err != nil {
+				return err
+			}
+		}
+	}
+	if rule.PrivateLabel != "" {
+		// The rule also gets a private twin: the same names under the
+		// label, pointing at the private addresses.
+		private := *rule
+		private.Target = strings.NewReplacer("$PUB4", "$PRI4", "$PUB6", "$PRI6").Replace(rule.Target)
+		// Reverse DNS follows the public name.
+		private.PTR = false
+		if private.ID != "" {
+			private.ID += "-private"
+		}
+		rule.PrivateLabel = ""
+		*rules = append(*rules, rule, &private)
+		return nil
+	}
+	*rules = append(*rules, rule)
+	return nil
+}
+
+// checkReferences checks that every @id target, fallback= and depends=
+// names a rule, and that dependencies don't form a cycle.
+func checkReferences(rules []*NameRule) error {
+	ids := map[string]bool{}
+	for _, rule := range rules {
+		ids[rule.ID] = rule.ID != ""
+	}
+	for _, rule := range rules {
+		if rule.Fallback != "" && !ids[rule.Fallback] {
+			return fmt.Errorf("Rule fallback= references unknown rule id '%s'", rule.Fallback)
+		}
+		if len(rule.Depends) > 0 && rule.ID == "" {
+			// Corrections are matched to rules by the ids in their records.
+			return fmt.Errorf("Rule %s has depends= but no id=", rule.FQDN)
+		}
+		for _, dep := range rule.Depends {
+			if !ids[dep] {
+				return fmt.Errorf("Rule depends= references unknown rule id '%s'", dep)
+			}
+		}
+		for _, t := range rule.Targets() {
+			if strings.HasPrefix(t, "@") && !ids[t[1:]] {
+				return fmt.Errorf("Target '%s' references unknown rule id '%s'", t, t[1:])
+			}
+		}
+	}
+	_, err := ruleDepths(rules)
+	return err
+}
+
+// ruleDepths gives each rule id the length of its longest chain of
+// depends=, so rules with no dependencies are 0 and are applied first.
+func ruleDepths(rules []*NameRule) (map[string]int, error) {
+	deps := map[string][]string{}
+	for _, rule := range rules {
+		if rule.ID != "" {
+			deps[rule.ID] = append(deps[rule.ID], rule.Depends...)
+		}
+	}
+	depths := map[string]int{}
+	visiting := map[string]bool{}
+	var depth func(id string) (int, error)
+	depth = func(id string) (int, error) {
+		if d, ok := depths[id]; ok {
+			return d, nil
+		}
+		if visiting[id] {
+			return 0, fmt.Errorf("Rule %s depends on itself through depends=", id)
+		}
+		visiting[id] = true
+		d := 0
+		for _, dep := range deps[id] {
+			dd, err := depth(dep)
+			if err != nil {
+				return 0, err
+			}
+			if dd+1 > d {
+				d = dd + 1
+			}
+		}
+		visiting[id] = false
+		depths[id] = d
+		return d, nil
+	}
+	for id := range deps {
+		if _, err := depth(id); err != nil {
+			return nil, err
+		}
+	}
+	return depths, nil
+}
+
+func (r *NameRule) hasReference() bool {
+	for _, t := range r.Targets() {
+		if strings.HasPrefix(t, "@") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitFallbacks separates the rules with fallback= from the rest.
+func splitFallbacks(rules []*NameRule) (primaries, fallbacks []*NameRule) {
+	for _, rule := range rules {
+		if rule.Fallback != "" {
+			fallbacks = append(fallbacks, rule)
+		} else {
+			primaries = append(primaries, rule)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// activeFallbacks returns the fallback rules whose rule produced no records
+// this sync, according to skips.
+func activeFallbacks(fallbacks, primaries []*NameRule, skips *skipReport) []*NameRule {
+	var active []*NameRule
+	for _, fb := range fallbacks {
+		n := 0
+		for _, rule := range primaries {
+			if rule.ID == fb.Fallback {
+				n += skips.produced[rule]
+			}
+		}
+		if n == 0 {
+			fb.logf(slog.LevelInfo, "Rule %s produced no records; using fallback %s %s", fb.Fallback, fb.Type, fb.FQDN)
+			active = append(active, fb)
+		}
+	}
+	return active
+}
+
+// referencesLast orders rules so those with @id targets come after the
+// rules they may reference.
+func referencesLast(rules []*NameRule) []*NameRule {
+	ordered := []*NameRule{}
+	refs := []*NameRule{}
+	for _, rule := range rules {
+		if rule.hasReference() {
+			refs = append(refs, rule)
+		} else {
+			ordered = append(ordered, rule)
+		}
+	}
+	return append(ordered, refs...)
+}
+
+/*
+
+# a maintenance page, only when the web rule produced no records
+A www.ssdv.win $PUB4 [web] id=web
+A www.ssdv.win 203.0.113.10 fallback=web
+# rules shared with other configs, relative to this file
+include common.cfg
+# the only zones records may be synced to; others are skipped
+zones ssdv.win
+# default TTL for records in a zone whose rule has no ttl=
+zone ssdv.win ttl=300
+# never delete records in a zone that also has manual records
+zone pvt.ssdv.win policy=append-only
+# or only delete the records whose names look like ours
+#zone ssdv.win manage-regex=`^(web|api)-`
+# no records for droplets tagged ci, or named like runner-1
+#exclude [ci]
+#exclude `^runner-\d+$`
+# never touch these names, whatever records they have; * matches across dots
+#ignore vpn.ssdv.win *.manual.ssdv.win
+A $DROP.ssdv.win $PUB4
+A $DROP.pvt.ssdv.win $PRI4
+# the same pair as one rule
+#A $DROP.ssdv.win $PUB4 private=pvt
+AAAA $DROP.ssdv.win $PUB6 feature=ipv6
+# records for other sources: kubernetes nodes, load-balancers or floating-ips
+#A $DROP.lb.ssdv.win $PUB4 source=load-balancers
+# zones served by cloudflare (CLOUDFLARE_API_KEY) or route53 (AWS_ACCESS_KEY_ID)
+#A $DROP.example.com $PUB4 provider=cloudflare
+SRV _mysql._tcp.pvt.ssdv.win $DROP.pvt.ssdv.win. 9104 [mysql]
+SRV _node._tcp.pvt.ssdv.win $DROP.pvt.ssdv.win. 9100
+# one SRV record per droplet, weighted by size or by a tag like weight-20
+SRV _api._tcp.ssdv.win $DROP.ssdv.win. 8080 [api] weight=vcpus id=api-srv depends=api-a
+SRV _web._tcp.ssdv.win $DROP.ssdv.win. 8080 [web] weight=tag:weight-
+# weight= and priority= default to 10; clients try lower priorities first
+SRV _mysql._tcp.ssdv.win $DROP.ssdv.win. 3306 weight=20 priority=5 [mysql-primary]
+# depends= applies the records of the rules it names first
+A $DROP.ssdv.win $PUB4 [api] id=api-a
+A *.$1.ssdv.win $PUB4 `[a-z][a-z]\-([a-z]+)\d\d`
+# $TAGPART is the part of the tag the label's glob matched, payments for team/payments
+A $DROP.$TAGPART.ssdv.win $PUB4 [team/*]
+# $TAG:key is the value of a key:value tag; records are skipped without it
+A $TAG:service.$TAG:env.ssdv.win $PUB4
+# [a,b] needs every tag, db.prod.ssdv.win for a droplet tagged role:db and env:prod
+A $DROP.$TAG:env.ssdv.win $PUB4 [role:db,env:*]
+# groups of a regex on a tag's value, web-42.ssdv.win for the tag gen:v42
+A web-$TAG:gen:1.ssdv.win $PUB4 [web] tag:gen=`v(\d+)`
+# $ANCHOR4 is the anchor IP floating IPs route through
+A $DROP.anchor.ssdv.win $ANCHOR4 [floating]
+# $FLOAT is the floating IP assigned to the droplet; droplets without one are skipped
+A $DROP.float.ssdv.win $FLOAT [floating]
+# $VPCRANGE is the IP range of the droplet's VPC, like 10.116.0.0/20
+# $DROPIP:name is the public IP of the droplet with that name
+A $DROP.egress.ssdv.win $DROPIP:gateway [app]
+# ${VAR:-default} falls back to default when the droplet has no $VAR
+A $DROP.${TAG:env:-dev}.ssdv.win $PUB4 [app]
+# ${VAR|lower} lowercases a value and ${VAR|label} makes it a valid DNS label,
+# web-1 for Web_1; $REGION is the region slug and $ID the droplet ID
+#A ${DROP|label}.$REGION.ssdv.win $PUB4 [web]
+#TXT _id.$DROP.ssdv.win "id=$ID" [web]
+# CNAME targets are fully qualified; TXT values may be quoted to hold spaces
+CNAME app.ssdv.win $DROP.ssdv.win. [app]
+TXT _info.$DROP.ssdv.win "role=web tier=front" [web]
+# MX rules take a preference after the target, 10 if left out
+MX ssdv.win $DROP.ssdv.win. 20 [mail]
+# flatten resolves a CNAME's target each sync and writes A/AAAA records,
+# for names like the apex that can't be CNAMEs
+#CNAME ssdv.win lb.example.net. [lb] flatten
+# ptr renames matching droplets to their record's name, setting the reverse
+# DNS of their addresses, when PTR_RENAME_DROPLETS is set; the name may only
+# use $DROP
+#A $DROP.ssdv.win $PUB4 [web] ptr
+# aggregate makes one round-robin record set of every matching droplet
+#A web.ssdv.win $PUB4 [web] aggregate
+# dc-service.ssdv.win only (essentially without number)
+#A $1.ssdv.win $PUB4 `([a-z][a-z]\-[a-z]+)\d\d`
+#A $1.pvt.ssdv.win $PRI4 `([a-z][a-z]\-[a-z]+)\d\d`
+# service.ssdv.win (across all dcs)
+#A $1.ssdv.win $PUB4 `[a-z][a-z]\-([a-z]+)\d\d`
+#A $1.pvt.ssdv.win $PRI4 `[a-z][a-z]\-([a-z]+)\d\d`
+
+*/
@@ -0,0 +1,197 @@
+package dnssync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRuleOptions(t *testing.T) {
+	dat := []byte("A $DROP.ssdv.win $PUB4 ttl=300 [web,api*] id=web region=nyc3 name=web1 zone=SSDV.win. meta:env=prod private=pvt.\n" +
+		"SRV _http._tcp.ssdv.win $DROP.ssdv.win. 80 weight=vcpus priority=5 region=sfo3\n" +
+		"MX ssdv.win mail.ssdv.win. 10 priority=20\n")
+	rules, _, err := parseRules("names.cfg", dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 {
+		t.Fatalf("got %d rules, want 4", len(rules))
+	}
+	a := rules[0]
+	if a.TTL != 300 || !a.TTLSet || a.Label != "web,api*" || a.ID != "web" || a.Region != "nyc3" ||
+		a.DropletName != "web1" || a.Zone != "ssdv.win" || a.Meta["env"] != "prod" {
+		t.Errorf("A rule options = %+v", a)
+	}
+	// private= adds a twin under the label, with the private address.
+	if p := rules[1]; p.PrivateLabel != "pvt" || p.ID != "web-private" || p.Target != "$PRI4" || p.TTL != 300 {
+		t.Errorf("private twin = %+v", p)
+	}
+	srv := rules[2]
+	if srv.Port != 80 || srv.WeightFrom != "vcpus" || srv.SrvPriority != 5 || srv.Region != "sfo3" {
+		t.Errorf("SRV rule options = %+v", srv)
+	}
+	// The priority= option overrides the positional preference.
+	if mx := rules[3]; mx.MxPreference != 20 {
+		t.Errorf("MX preference = %d, want 20", mx.MxPreference)
+	}
+}
+
+func TestParseRuleOptionsInvalid(t *testing.T) {
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{"A $DROP.ssdv.win $PUB4 colour=blue", "Unknown rule option 'colour'"},
+		{"A $DROP.ssdv.win $PUB4 ttl=0", "Bad ttl '0'"},
+		{"A $DROP.ssdv.win $PUB4 ttl=soon", "Bad ttl 'soon'"},
+		{"A $DROP.ssdv.win $PUB4 port=80", "'port' is only valid on SRV rules"},
+		{"A $DROP.ssdv.win $PUB4 priority=1", "'priority' is only valid on SRV and MX rules"},
+		{"SRV _http._tcp.ssdv.win $DROP.ssdv.win. 80 weight=70000", "Bad weight '70000'"},
+		{"CNAME www.ssdv.win $DROP.ssdv.win. private=pvt", "'private' is only valid on A and AAAA rules"},
+		{"A $DROP.ssdv.win $PUB4 pub4cidr=10.0.0.0", "Bad pub4cidr '10.0.0.0'"},
+		{"A $DROP.ssdv.win $PUB4 provider=bind", "Unknown provider 'bind'"},
+		{"A $DROP.ssdv.win $PUB4 meta=/v1/hostname", "Bad meta URL '/v1/hostname'"},
+		{"A $DROP.ssdv.win $PUB4 tag:env=prod", "Option 'tag:env' needs a regex in backticks"},
+		{"A $DROP.ssdv.win $PUB4 [web,]", "Bad tag pattern 'web,': empty tag"},
+		{"A $DROP.ssdv.win $PUB4 sometimes", "Unexpected rule part 'sometimes'"},
+	}
+	for _, tt := range tests {
+		_, _, err := parseRules("names.cfg", []byte(tt.line+"\n"))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want %q", tt.line, err, tt.err)
+		} else if !strings.HasPrefix(err.Error(), "names.cfg:1: ") {
+			t.Errorf("%s: err = %v, want it to give the line", tt.line, err)
+		}
+	}
+}
+
+// writeConfigs writes files, by name, to a temporary directory and returns
+// its path.
+func writeConfigs(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, dat := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(dat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestIncludes(t *testing.T) {
+	defer func(n string) { namesCfg = n }(namesCfg)
+	dir := writeConfigs(t, map[string]string{
+		"names.cfg":  "include web.cfg\ninclude db.cfg\nA $DROP.ssdv.win $PUB4\n",
+		"web.cfg":    "include common.cfg\nCNAME www.ssdv.win web.ssdv.win.\n",
+		"db.cfg":     "include common.cfg\n",
+		"common.cfg": "TXT ssdv.win \"v=spf1 -all\"\n",
+	})
+	namesCfg = filepath.Join(dir, "names.cfg")
+	// common.cfg is included twice, which is not a cycle.
+	rules, _, err := readRules(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 {
+		t.Errorf("got %d rules, want 4", len(rules))
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	defer func(n string) { namesCfg = n }(namesCfg)
+	dir := writeConfigs(t, map[string]string{
+		"names.cfg": "include a.cfg\n",
+		"a.cfg":     "include b.cfg\n",
+		"b.cfg":     "include ./a.cfg\n",
+	})
+	namesCfg = filepath.Join(dir, "names.cfg")
+	_, _, err := readRules(context.Background())
+	want := "Include cycle: " + strings.Join([]string{namesCfg, filepath.Join(dir, "a.cfg"), filepath.Join(dir, "b.cfg"), filepath.Join(dir, "a.cfg")}, " -> ")
+	if err == nil || err.Error() != want {
+		t.Errorf("err = %v, want %q", err, want)
+	}
+}
+
+func TestIncludeErrorLine(t *testing.T) {
+	defer func(n string) { namesCfg = n }(namesCfg)
+	dir := writeConfigs(t, map[string]string{
+		"names.cfg": "A $DROP.ssdv.win $PUB4\ninclude web.cfg\nA bad\n",
+		"web.cfg":   "# web\nA $DROP.web.ssdv.win $PUB4 colour=blue\n",
+	})
+	namesCfg = filepath.Join(dir, "names.cfg")
+	_, _, err := readRules(context.Background())
+	if want := filepath.Join(dir, "web.cfg") + ":2: "; err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("err = %v, want it at %s", err, want)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "web.cfg"), []byte("# web\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = readRules(context.Background())
+	if want := namesCfg + ":3: "; err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("err = %v, want it at %s", err, want)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	defer func(n, o string) { namesCfg, namesOverlay = n, o }(namesCfg, namesOverlay)
+	dir := writeConfigs(t, map[string]string{
+		"names.cfg":   "zone ssdv.win ttl=300\nA $DROP.ssdv.win $PUB4 id=web\nA $DROP.pvt.ssdv.win $PRI4 id=pvt\n",
+		"staging.cfg": "zone ssdv.win ttl=60\nA $DROP.staging.ssdv.win $PUB4 id=web\nA api.ssdv.win 10.0.0.1\n",
+	})
+	namesCfg = filepath.Join(dir, "names.cfg")
+	namesOverlay = filepath.Join(dir, "staging.cfg")
+	rules, zones, err := readRules(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fqdns []string
+	for _, r := range rules {
+		fqdns = append(fqdns, r.ID+" "+r.FQDN)
+	}
+	// The overlay's web rule replaces the base's in place; its other rule
+	// is added.
+	want := []string{"web $DROP.staging.ssdv.win", "pvt $DROP.pvt.ssdv.win", " api.ssdv.win"}
+	if strings.Join(fqdns, ", ") != strings.Join(want, ", ") {
+		t.Errorf("rules = %q, want %q", fqdns, want)
+	}
+	if zones.TTLs["ssdv.win"] != 60 {
+		t.Errorf("zone ttl = %d, want the overlay's 60", zones.TTLs["ssdv.win"])
+	}
+}
+
+func TestOverlayIncludeCycle(t *testing.T) {
+	defer func(n, o string) { namesCfg, namesOverlay = n, o }(namesCfg, namesOverlay)
+	dir := writeConfigs(t, map[string]string{
+		"names.cfg":   "A $DROP.ssdv.win $PUB4\n",
+		"staging.cfg": "include extra.cfg\n",
+		"extra.cfg":   "include staging.cfg\n",
+	})
+	namesCfg = filepath.Join(dir, "names.cfg")
+	namesOverlay = filepath.Join(dir, "staging.cfg")
+	_, _, err := readRules(context.Background())
+	if err == nil || !strings.HasPrefix(err.Error(), "Include cycle: "+namesOverlay+" -> ") {
+		t.Errorf("err = %v, want an include cycle through the overlay", err)
+	}
+}
+
+func TestOverlayBadReference(t *testing.T) {
+	defer func(n, o string) { namesCfg, namesOverlay = n, o }(namesCfg, namesOverlay)
+	dir := writeConfigs(t, map[string]string{
+		"names.cfg":   "A $DROP.ssdv.win $PUB4 id=web\n",
+		"staging.cfg": "CNAME www.ssdv.win @web\n",
+	})
+	namesCfg = filepath.Join(dir, "names.cfg")
+	// References are checked after merging, so the overlay may refer to
+	// the base's rules, but not to rules neither defines.
+	namesOverlay = filepath.Join(dir, "staging.cfg")
+	if _, _, err := readRules(context.Background()); err != nil {
+		t.Errorf("overlay referring to a base rule: %v", err)
+	}
+	if err := os.WriteFile(namesOverlay, []byte("CNAME api.ssdv.win @app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readRules(context.Background()); err == nil {
+		t.Error("overlay referring to a missing rule loaded without error")
+	}
+}
@@ -0,0 +1,65 @@
+package dnssync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// runReportFile, when set, is overwritten after every sync with a JSON
+// report of it, for dashboards that poll a file.
+var runReportFile = os.Getenv("RUN_REPORT_FILE")
+
+// runReport is the JSON written to runReportFile.
+type runReport struct {
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds"`
+	Droplets int       `json:"droplets"`
+	// Zones counts the corrections applied, or planned, in each zone.
+	Zones   map[string]int  `json:"zones"`
+	Error   string          `json:"error,omitempty"`
+	Skipped []skippedRecord `json:"skipped"`
+}
+
+// writeRunReport writes the report of the sync that started at start and
+// ended with sum and err to runReportFile.
+func writeRunReport(start time.Time, sum Summary, err error) {
+	if runReportFile == "" {
+		return
+	}
+	r := runReport{
+		Time:     start,
+		Duration: time.Since(start).Seconds(),
+		Droplets: sum.Droplets,
+		Zones:    map[string]int{},
+		Skipped:  sum.skipped,
+	}
+	if r.Skipped == nil {
+		r.Skipped = []skippedRecord{}
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	for _, a := range sum.Applied {
+		r.Zones[strings.SplitN(a, ": ", 2)[0]]++
+	}
+	if planning() {
+		for _, p := range planned {
+			r.Zones[p.Zone]++
+		}
+	}
+	dat, err := json.MarshalIndent(r, "", "  ")
+	if err == nil {
+		// Write then rename, so pollers never read a partial report.
+		tmp := runReportFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, dat, 0644); err == nil {
+			err = os.Rename(tmp, runReportFile)
+		}
+	}
+	if err != nil {
+		slog.Error("Error writing RUN_REPORT_FILE", "error", err)
+	}
+}
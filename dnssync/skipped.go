@@ -0,0 +1,123 @@
+package dnssync
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+// Reason codes for records a rule matched a droplet for but couldn't produce.
+const (
+	skipNoPrivateIP     = "no-private-ip"
+	skipMissingVariable = "missing-variable"
+	skipBadName         = "bad-name"
+	skipBadTarget       = "bad-target"
+	skipMissingRef      = "missing-reference"
+	skipNoZone          = "no-zone"
+	skipNoMetadata      = "no-metadata"
+	skipNameTooLong     = "name-too-long"
+	skipZoneNotAllowed  = "zone-not-allowed"
+	skipUnresolved      = "unresolved"
+	skipIgnored         = "ignored"
+)
+
+// skippedRecord describes one record that wasn't produced and why.
+type skippedRecord struct {
+	Droplet string `json:"droplet"`
+	Rule    string `json:"rule,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Reason  string `json:"reason"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// skipReport collects the records skipped while computing the desired state
+// so they can be reported together at the end of a sync. It also counts the
+// records each rule did produce, and which rule first produced each name and
+// type, for Preflight.
+type skipReport struct {
+	records  []skippedRecord
+	produced map[*NameRule]int
+	owners   map[string]*NameRule
+	// conflicts describes names produced by more than one rule.
+	conflicts []string
+}
+
+func newSkipReport() *skipReport {
+	return &skipReport{produced: map[*NameRule]int{}, owners: map[string]*NameRule{}}
+}
+
+// produce notes that rule produced rec.
+func (s *skipReport) produce(rule *NameRule, rec *models.RecordConfig) {
+	s.produced[rule]++
+	key := rec.Type + " " + rec.NameFQDN
+	owner, ok := s.owners[key]
+	if !ok {
+		s.owners[key] = rule
+	} else if owner != rule {
+		c := fmt.Sprintf("%s is produced by rules %s and %s", key, ruleName(owner), ruleName(rule))
+		for _, seen := range s.conflicts {
+			if seen == c {
+				return
+			}
+		}
+		s.conflicts = append(s.conflicts, c)
+	}
+}
+
+func (s *skipReport) add(rule *NameRule, drop, name, reason, format string, args ...interface{}) {
+	s.records = append(s.records, skippedRecord{
+		Droplet: drop,
+		Rule:    rule.ID,
+		Type:    rule.Type,
+		Name:    name,
+		Reason:  reason,
+		Detail:  fmt.Sprintf(format, args...),
+	})
+}
+
+// counts returns the number of skipped records for each reason code.
+func (s *skipReport) counts() map[string]int {
+	counts := map[string]int{}
+	for _, rec := range s.records {
+		counts[rec.Reason]++
+	}
+	return counts
+}
+
+// log writes a summary entry and one entry per skipped record.
+func (s *skipReport) log() {
+	if len(s.records) == 0 {
+		return
+	}
+	counts := s.counts()
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	summary := ""
+	for _, reason := range reasons {
+		summary += fmt.Sprintf(" %s=%d", reason, counts[reason])
+	}
+	slog.Info("Skipped records", "records", len(s.records), "reasons", strings.TrimSpace(summary))
+	for _, rec := range s.records {
+		slog.Info("Skipped record", "droplet", rec.Droplet, "rule", rec.Rule, "type", rec.Type, "name", rec.Name, "reason", rec.Reason, "detail", rec.Detail)
+	}
+}
+
+var (
+	skippedMu sync.Mutex
+	// lastSkipped is the skip report of the last sync, served on /skipped.
+	lastSkipped []skippedRecord
+)
+
+func publishSkipped(s *skipReport) {
+	skippedMu.Lock()
+	lastSkipped = s.records
+	skippedMu.Unlock()
+}
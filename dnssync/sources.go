@@ -0,0 +1,325 @@
+package dnssync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/godo"
+)
+
+// Instance is a machine a Source lists records for: a droplet, a
+// Kubernetes node, a load balancer or a floating IP. Sources other than the
+// droplet list describe theirs as a droplet with what they have, chiefly
+// the name, tags, region and addresses, so the same rules and variables,
+// like $DROP and $PUB4, work for all of them.
+type Instance struct {
+	godo.Droplet
+	// Source is the name of the source that listed the instance.
+	Source string
+}
+
+// Key identifies inst across syncs: its source and ID, or its name when the
+// source gives it no ID.
+func (inst Instance) Key() string {
+	if inst.ID == 0 {
+		return inst.Source + "/" + inst.Name
+	}
+	return inst.Source + "/" + strconv.Itoa(inst.ID)
+}
+
+// Source lists the instances rules produce records for.
+type Source interface {
+	List(ctx context.Context) ([]Instance, error)
+}
+
+// instances returns drops as instances of the source with this name.
+func instances(name string, drops []godo.Droplet) []Instance {
+	insts := make([]Instance, 0, len(drops))
+	for _, drop := range drops {
+		insts = append(insts, Instance{Droplet: drop, Source: name})
+	}
+	return insts
+}
+
+// Source names, as given to a rule's source= option.
+const (
+	sourceDroplets      = "droplets"
+	sourceKubernetes    = "kubernetes"
+	sourceLoadBalancers = "load-balancers"
+	sourceFloatingIPs   = "floating-ips"
+)
+
+// sourceNames lists the valid source names.
+var sourceNames = []string{sourceDroplets, sourceKubernetes, sourceLoadBalancers, sourceFloatingIPs}
+
+// newSource returns the source with this name. Tag limits the droplets
+// source to droplets carrying it.
+func newSource(name string, client *godo.Client, tag string) (Source, error) {
+	switch name {
+	case sourceDroplets:
+		return dropletSource{client: client, tag: tag}, nil
+	case sourceKubernetes:
+		return nodePoolSource{client: client}, nil
+	case sourceLoadBalancers:
+		return loadBalancerSource{client: client}, nil
+	case sourceFloatingIPs:
+		return floatingIPSource{client: client}, nil
+	}
+	return nil, fmt.Errorf("Unknown source '%s', must be one of %s", name, strings.Join(sourceNames, ", "))
+}
+
+// ruleSources returns the names of the sources other than droplets that
+// rules use, sorted.
+func ruleSources(rules []*NameRule) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, rule := range rules {
+		if src := rule.source(); src != sourceDroplets && !seen[src] {
+			seen[src] = true
+			names = append(names, src)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sourceRules returns the rules of rules that use the source with this name.
+func sourceRules(rules []*NameRule, name string) []*NameRule {
+	kept := []*NameRule{}
+	for _, rule := range rules {
+		if rule.source() == name {
+			kept = append(kept, rule)
+		}
+	}
+	return kept
+}
+
+// listInstances lists the droplets, only those carrying the tag every
+// droplet rule shares if there is one, and the instances of the other
+// sources rules use. If the droplet listing fails partway, the droplets
+// from before the failure are returned with its error, as DropletList
+// returns them, and the other sources aren't listed.
+func listInstances(ctx context.Context, client *godo.Client, rules []*NameRule) ([]Instance, error) {
+	src, err := newSource(sourceDroplets, client, commonTag(sourceRules(rules, sourceDroplets)))
+	if err != nil {
+		return nil, err
+	}
+	insts, err := src.List(ctx)
+	if err != nil {
+		return insts, err
+	}
+	for _, name := range ruleSources(rules) {
+		if src, err = newSource(name, client, ""); err != nil {
+			return nil, err
+		}
+		more, err := src.List(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Listing %s: %w", name, err)
+		}
+		insts = append(insts, more...)
+	}
+	return insts, nil
+}
+
+// filterInstances applies the filters every sync's instances go through,
+// whatever their source: DROPLET_ALLOWLIST, DUPLICATE_NAMES and
+// MIN_DROPLET_AGE.
+func filterInstances(ctx context.Context, insts []Instance) ([]Instance, error) {
+	insts, err := allowedDroplets(ctx, insts)
+	if err != nil {
+		return nil, err
+	}
+	if insts, err = resolveDuplicates(insts); err != nil {
+		return nil, err
+	}
+	return matureDroplets(insts), nil
+}
+
+// withInstances returns a copy of insts, by source, with the instances of
+// source replaced by these.
+func withInstances(insts map[string][]Instance, source string, these []Instance) map[string][]Instance {
+	out := make(map[string][]Instance, len(insts)+1)
+	for name, list := range insts {
+		out[name] = list
+	}
+	out[source] = these
+	return out
+}
+
+// bySource groups insts by the name of their source.
+func bySource(insts []Instance) map[string][]Instance {
+	groups := map[string][]Instance{}
+	for _, inst := range insts {
+		groups[inst.Source] = append(groups[inst.Source], inst)
+	}
+	return groups
+}
+
+// dropletSource lists droplets, only those carrying tag if it is set.
+type dropletSource struct {
+	client *godo.Client
+	tag    string
+}
+
+func (s dropletSource) List(ctx context.Context) ([]Instance, error) {
+	drops, err := DropletList(ctx, s.client, s.tag)
+	return instances(sourceDroplets, drops), err
+}
+
+// nodePoolSource lists the nodes of Kubernetes clusters. Each node is its
+// droplet, with the tags of its pool and cluster added.
+type nodePoolSource struct {
+	client *godo.Client
+}
+
+func (s nodePoolSource) List(ctx context.Context) ([]Instance, error) {
+	var clusters []*godo.KubernetesCluster
+	opt := &godo.ListOptions{}
+	for {
+		var list []*godo.KubernetesCluster
+		var resp *godo.Response
+		err := withRetry(ctx, "listing Kubernetes clusters", func() error {
+			var err error
+			list, resp, err = s.client.Kubernetes.List(ctx, opt)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, list...)
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opt.Page = page + 1
+	}
+	insts := []Instance{}
+	for _, cluster := range clusters {
+		// Node droplets are tagged with their cluster's ID.
+		drops, err := DropletList(ctx, s.client, "k8s:"+cluster.ID)
+		if err != nil {
+			return nil, err
+		}
+		pools := map[int]*godo.KubernetesNodePool{}
+		for _, pool := range cluster.NodePools {
+			for _, node := range pool.Nodes {
+				if id, err := strconv.Atoi(node.DropletID); err == nil {
+					pools[id] = pool
+				}
+			}
+		}
+		for _, drop := range drops {
+			pool, ok := pools[drop.ID]
+			if !ok {
+				continue
+			}
+			tags := append([]string{}, drop.Tags...)
+			tags = append(tags, pool.Tags...)
+			drop.Tags = append(tags, cluster.Tags...)
+			insts = append(insts, Instance{Droplet: drop, Source: sourceKubernetes})
+		}
+	}
+	return insts, nil
+}
+
+// loadBalancerSource lists load balancers, with their IP as the public
+// address.
+type loadBalancerSource struct {
+	client *godo.Client
+}
+
+func (s loadBalancerSource) List(ctx context.Context) ([]Instance, error) {
+	insts := []Instance{}
+	opt := &godo.ListOptions{}
+	for {
+		var list []godo.LoadBalancer
+		var resp *godo.Response
+		err := withRetry(ctx, "listing load balancers", func() error {
+			var err error
+			list, resp, err = s.client.LoadBalancers.List(ctx, opt)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, lb := range list {
+			inst := Instance{Source: sourceLoadBalancers, Droplet: godo.Droplet{
+				Name:     lb.Name,
+				Tags:     lb.Tags,
+				Region:   lb.Region,
+				Status:   lb.Status,
+				Created:  lb.Created,
+				VPCUUID:  lb.VPCUUID,
+				Networks: &godo.Networks{},
+			}}
+			if lb.IP != "" {
+				inst.Networks.V4 = []godo.NetworkV4{{IPAddress: lb.IP, Type: "public"}}
+			}
+			if lb.IPv6 != "" {
+				inst.Networks.V6 = []godo.NetworkV6{{IPAddress: lb.IPv6, Type: "public"}}
+			}
+			insts = append(insts, inst)
+		}
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opt.Page = page + 1
+	}
+	return insts, nil
+}
+
+// floatingIPSource lists floating IPs, with the IP as the public address.
+// An assigned IP takes the name, ID and tags of its droplet; an unassigned
+// one is named after the IP with dashes, like 203-0-113-7.
+type floatingIPSource struct {
+	client *godo.Client
+}
+
+func (s floatingIPSource) List(ctx context.Context) ([]Instance, error) {
+	insts := []Instance{}
+	opt := &godo.ListOptions{}
+	for {
+		var list []godo.FloatingIP
+		var resp *godo.Response
+		err := withRetry(ctx, "listing floating IPs", func() error {
+			var err error
+			list, resp, err = s.client.FloatingIPs.List(ctx, opt)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, fip := range list {
+			inst := Instance{Source: sourceFloatingIPs, Droplet: godo.Droplet{
+				Name:     strings.Replace(fip.IP, ".", "-", -1),
+				Region:   fip.Region,
+				Networks: &godo.Networks{V4: []godo.NetworkV4{{IPAddress: fip.IP, Type: "public"}}},
+			}}
+			if fip.Droplet != nil {
+				inst.ID = fip.Droplet.ID
+				inst.Name = fip.Droplet.Name
+				inst.Tags = fip.Droplet.Tags
+			}
+			insts = append(insts, inst)
+		}
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opt.Page = page + 1
+	}
+	return insts, nil
+}
@@ -0,0 +1,63 @@
+package dnssync
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+func TestFilterInstancesAllSources(t *testing.T) {
+	defer func(a string, d time.Duration) { dropletAllowlist, minDropletAge = a, d }(dropletAllowlist, minDropletAge)
+	dropletAllowlist = filepath.Join(t.TempDir(), "allow")
+	if err := ioutil.WriteFile(dropletAllowlist, []byte("web\nlb1\n3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	minDropletAge = time.Hour
+	old := time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+	young := time.Now().Format(time.RFC3339)
+	insts := []Instance{
+		{Source: sourceDroplets, Droplet: godo.Droplet{ID: 1, Name: "web", Created: old}},
+		{Source: sourceDroplets, Droplet: godo.Droplet{ID: 2, Name: "db", Created: old}},
+		// The same name in another source isn't a duplicate.
+		{Source: sourceLoadBalancers, Droplet: godo.Droplet{Name: "web", Created: old}},
+		{Source: sourceLoadBalancers, Droplet: godo.Droplet{Name: "lb1", Created: young}},
+		{Source: sourceLoadBalancers, Droplet: godo.Droplet{Name: "lb2", Created: old}},
+		{Source: sourceFloatingIPs, Droplet: godo.Droplet{ID: 3, Name: "float"}},
+	}
+	got, err := filterInstances(context.Background(), insts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, inst := range got {
+		keys = append(keys, inst.Key())
+	}
+	want := []string{"droplets/1", "load-balancers/web", "floating-ips/3"}
+	if len(keys) != len(want) {
+		t.Fatalf("kept %v, want %v", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("kept %v, want %v", keys, want)
+		}
+	}
+}
+
+func TestResolveDuplicatesPerSource(t *testing.T) {
+	insts := []Instance{
+		{Source: sourceLoadBalancers, Droplet: godo.Droplet{Name: "web"}},
+		{Source: sourceLoadBalancers, Droplet: godo.Droplet{Name: "web"}},
+		{Source: sourceDroplets, Droplet: godo.Droplet{ID: 5, Name: "web"}},
+	}
+	got, err := resolveDuplicates(insts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Source != sourceLoadBalancers || got[1].Source != sourceDroplets {
+		t.Fatalf("kept %+v", got)
+	}
+}
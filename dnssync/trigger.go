@@ -0,0 +1,71 @@
+package dnssync
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+)
+
+// syncJitter, when set, adds a random delay of up to it to each wait
+// between syncs, so instances started together don't poll in lockstep.
+var syncJitter = envDuration("SYNC_JITTER", 0)
+
+// triggerToken, when set, is the bearer token POST /sync requires. Without
+// it POST /sync is only served on a loopback listen address.
+var triggerToken = os.Getenv("SYNC_TRIGGER_TOKEN")
+
+// triggered holds a pending request for Run to sync right away. Requests
+// made while one is pending are merged into it.
+var triggered = make(chan struct{}, 1)
+
+// TriggerSync asks Run to start its next sync now rather than at the end of
+// its interval.
+func TriggerSync() {
+	select {
+	case triggered <- struct{}{}:
+	default:
+	}
+}
+
+// serveTrigger handles POST /sync, for provisioning pipelines to ask for a
+// sync right after creating or destroying droplets.
+func serveTrigger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if triggerToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+triggerToken)) != 1 {
+		http.Error(w, "bad or missing token", http.StatusUnauthorized)
+		return
+	}
+	slog.Info("Sync requested", "remote", r.RemoteAddr)
+	TriggerSync()
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "sync queued")
+}
+
+// waitForSync waits interval plus up to syncJitter from since, or less when
+// TriggerSync is called, though never less than minSyncInterval. It returns
+// early with ctx's error when it is done.
+func waitForSync(ctx context.Context, since time.Time, interval time.Duration) error {
+	d := interval
+	if syncJitter > 0 {
+		d += time.Duration(rand.Int63n(int64(syncJitter)))
+	}
+	timer := time.NewTimer(time.Until(since.Add(d)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-triggered:
+		return sleep(ctx, time.Until(since.Add(minSyncInterval)))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,47 @@
+package dnssync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"localhost:9090", true},
+		{"127.0.0.1:9090", true},
+		{"[::1]:9090", true},
+		{":9090", false},
+		{"0.0.0.0:9090", false},
+		{"10.0.0.4:9090", false},
+		{"example.com:9090", false},
+		{"9090", false},
+	}
+	for _, tt := range tests {
+		if got := loopbackAddr(tt.addr); got != tt.want {
+			t.Errorf("loopbackAddr(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestTriggerNeedsTokenOffLoopback(t *testing.T) {
+	defer func(tok string) { triggerToken = tok }(triggerToken)
+	tests := []struct {
+		token, addr string
+		served      bool
+	}{
+		{"", ":9090", false},
+		{"", "127.0.0.1:9090", true},
+		{"secret", ":9090", true},
+	}
+	for _, tt := range tests {
+		triggerToken = tt.token
+		_, pattern := metricsMux(tt.addr).Handler(httptest.NewRequest(http.MethodPost, "/sync", nil))
+		if served := pattern == "/sync"; served != tt.served {
+			t.Errorf("token %q on %s: /sync served = %v, want %v", tt.token, tt.addr, served, tt.served)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package dnssync
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/godo"
+)
+
+// regexGroups returns the $1, $2, ... and $name values a rule's regex
+// captured from a droplet name.
+func regexGroups(rule *NameRule, matches []string) map[string]string {
+	groups := map[string]string{}
+	for i := 1; i < len(matches); i++ {
+		groups[fmt.Sprintf("$%d", i)] = matches[i]
+		if name := rule.Regex.SubexpNames()[i]; name != "" {
+			groups["$"+name] = matches[i]
+		}
+	}
+	return groups
+}
+
+// tagGroups matches the rule's tag:key=`regex` options against drop's tags,
+// returning the $TAG:key:1, ... values they captured. It reports false if
+// the droplet lacks one of the tags or its value doesn't match.
+func tagGroups(rule *NameRule, drop godo.Droplet) (map[string]string, bool) {
+	groups := map[string]string{}
+	for key, re := range rule.TagRegex {
+		v := tagValue(drop, key)
+		if v == "" {
+			return nil, false
+		}
+		matches := re.FindStringSubmatch(v)
+		if matches == nil {
+			return nil, false
+		}
+		for i := 1; i < len(matches); i++ {
+			groups[fmt.Sprintf("$TAG:%s:%d", key, i)] = matches[i]
+			if name := re.SubexpNames()[i]; name != "" {
+				groups["$TAG:"+key+":"+name] = matches[i]
+			}
+		}
+	}
+	return groups, true
+}
+
+// privatePrefer picks $PRI4 for droplets with both a VPC and a legacy
+// private networking address: "vpc" or "legacy". Unset takes the first
+// private address the API lists.
+var privatePrefer = os.Getenv("PRIVATE_IP_PREFER")
+
+// privateIPv4s returns all of drop's private IPv4 addresses.
+func privateIPv4s(drop godo.Droplet) []string {
+	var ips []string
+	if drop.Networks == nil {
+		return ips
+	}
+	for _, n := range drop.Networks.V4 {
+		if n.Type == "private" {
+			ips = append(ips, n.IPAddress)
+		}
+	}
+	return ips
+}
+
+// preferredPrivateIPv4 returns drop's VPC or legacy private address, per
+// privatePrefer, given the range of drop's VPC. It falls back to the other
+// kind when drop lacks the preferred one.
+func preferredPrivateIPv4(drop godo.Droplet, vpcRange *net.IPNet) string {
+	var vpc, legacy string
+	for _, ip := range privateIPv4s(drop) {
+		if vpcRange.Contains(net.ParseIP(ip)) {
+			if vpc == "" {
+				vpc = ip
+			}
+		} else if legacy == "" {
+			legacy = ip
+		}
+	}
+	if privatePrefer == "legacy" && legacy != "" || vpc == "" {
+		return legacy
+	}
+	return vpc
+}
+
+// anchorIPv4 returns drop's anchor IPv4 address, the one floating IPs are
+// routed through, if its networks list one. Droplets whose listing has no
+// anchor network get no $ANCHOR4; the droplet's own metadata service has it
+// at /metadata/v1/interfaces/public/0/anchor_ipv4/address, for use with
+// meta=.
+func anchorIPv4(drop godo.Droplet) string {
+	if drop.Networks == nil {
+		return ""
+	}
+	for _, n := range drop.Networks.V4 {
+		if n.Type == "anchor" {
+			return n.IPAddress
+		}
+	}
+	return ""
+}
+
+// privateIPv6 returns drop's private IPv6 address, if it has one.
+func privateIPv6(drop godo.Droplet) string {
+	if drop.Networks == nil {
+		return ""
+	}
+	for _, n := range drop.Networks.V6 {
+		if n.Type == "private" {
+			return n.IPAddress
+		}
+	}
+	return ""
+}
+
+// tagVar matches $TAG:key, which expands to the value of the droplet's
+// key:value tag.
+var tagVar = regexp.MustCompile(`\$TAG:([A-Za-z0-9_-]+)`)
+
+// dropIPVar matches $DROPIP:name, which expands to the public IPv4 address
+// of the droplet with that name, for records pointing at a shared droplet
+// like a gateway. Names with dots can't be given. The droplet is found among
+// all the droplets listed, whether or not it matches the rule's tag.
+var dropIPVar = regexp.MustCompile(`\${?DROPIP:([A-Za-z0-9_-]+)`)
+
+// dropletIPs maps the name of each of drops to its public IPv4 address.
+func dropletIPs(drops []Instance) map[string]string {
+	ips := map[string]string{}
+	for _, drop := range drops {
+		if ip, _ := drop.PublicIPv4(); ip != "" {
+			ips[drop.Name] = ip
+		}
+	}
+	return ips
+}
+
+// tagValue returns the value of drop's first key:value tag with this key.
+// Under TAG_IGNORE_CASE the key matches as it does in tag patterns.
+func tagValue(drop godo.Droplet, key string) string {
+	for _, t := range drop.Tags {
+		if tagIgnoreCase {
+			t = strings.TrimSpace(t)
+			if len(t) > len(key) && t[len(key)] == ':' && strings.EqualFold(t[:len(key)], key) {
+				return t[len(key)+1:]
+			}
+			continue
+		}
+		if v := strings.TrimPrefix(t, key+":"); v != t {
+			return v
+		}
+	}
+	return ""
+}
+
+// defaultVar matches ${NAME} and ${NAME:-default}, which is the value of
+// $NAME, or the expansion of default if $NAME has none. Either form may pipe
+// the value through modifiers, as in ${DROP|label} or ${TAG:env|lower:-dev}.
+var defaultVar = regexp.MustCompile(`\$\{([^{}|]*?)((?:\|[a-z]+)*)(:-([^{}]*))?\}`)
+
+// varModifiers are the modifiers ${NAME|modifier} can apply, by name.
+var varModifiers = map[string]func(string) string{
+	"lower": strings.ToLower,
+	"label": hostLabel,
+}
+
+// invalidLabelChars matches the runs of characters a DNS label can't have.
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// hostLabel makes v a valid DNS label, lowercasing it and replacing each run
+// of other characters, dots included, with a dash: web-1 for Web_1.
+func hostLabel(v string) string {
+	v = invalidLabelChars.ReplaceAllString(strings.ToLower(v), "-")
+	if len(v) > 63 {
+		v = v[:63]
+	}
+	return strings.Trim(v, "-")
+}
+
+// checkModifiers checks that the ${} forms in s only use known modifiers.
+func checkModifiers(s string) error {
+	for _, m := range defaultVar.FindAllStringSubmatch(s, -1) {
+		for _, mod := range strings.Split(m[2], "|")[1:] {
+			if varModifiers[mod] == nil {
+				return fmt.Errorf("Unknown modifier '%s' in '%s', must be lower or label", mod, m[0])
+			}
+		}
+	}
+	return nil
+}
+
+// replace expands the droplet variables and regex groups in base. Values in
+// vars take precedence over those read from the droplet. Longer variable
+// names are matched first, so $10 is not read as $1 followed by a 0, and
+// substituted values are never expanded again. It reports false if base uses
+// a droplet variable that has no value, like $PUB6 on a droplet without
+// IPv6, unless it gives a default as in ${PUB6:-$PUB4}; an empty regex group
+// is fine.
+func replace(base string, drop godo.Droplet, groups, vars map[string]string) (string, bool) {
+	out := ""
+	for {
+		loc := defaultVar.FindStringSubmatchIndex(base)
+		if loc == nil {
+			break
+		}
+		before, ok := expand(base[:loc[0]], drop, groups, vars)
+		if !ok {
+			return "", false
+		}
+		name := "$" + base[loc[2]:loc[3]]
+		v, ok := expand(name, drop, groups, vars)
+		if v == name {
+			// Not a variable at all.
+			ok = false
+		}
+		if loc[6] >= 0 && (!ok || v == "") {
+			v, ok = expand(base[loc[8]:loc[9]], drop, groups, vars)
+		}
+		if !ok {
+			return "", false
+		}
+		for _, mod := range strings.Split(base[loc[4]:loc[5]], "|")[1:] {
+			v = varModifiers[mod](v)
+		}
+		out += before + v
+		base = base[loc[1]:]
+	}
+	rest, ok := expand(base, drop, groups, vars)
+	if !ok {
+		return "", false
+	}
+	return out + rest, true
+}
+
+// expand does the work of replace for text without ${} forms.
+func expand(base string, drop godo.Droplet, groups, vars map[string]string) (string, bool) {
+	name := drop.Name
+	if dropSeparator != "" {
+		name = strings.Replace(name, ".", dropSeparator, -1)
+	}
+	pub4, _ := drop.PublicIPv4()
+	pri4, _ := drop.PrivateIPv4()
+	pub6, _ := drop.PublicIPv6()
+	region, id := "", ""
+	if drop.Region != nil {
+		region = drop.Region.Slug
+	}
+	if drop.ID != 0 {
+		// Load balancers and unassigned floating IPs have no ID.
+		id = strconv.Itoa(drop.ID)
+	}
+	all := map[string]string{
+		"$DROP":    name,
+		"$PUB4":    pub4,
+		"$PRI4":    pri4,
+		"$PUB6":    pub6,
+		"$PRI6":    privateIPv6(drop),
+		"$SIZE":    drop.SizeSlug,
+		"$ANCHOR4": anchorIPv4(drop),
+		"$REGION":  region,
+		"$ID":      id,
+	}
+	for _, m := range tagVar.FindAllStringSubmatch(base, -1) {
+		all[m[0]] = tagValue(drop, m[1])
+	}
+	for k, v := range vars {
+		all[k] = v
+	}
+	for k, v := range groups {
+		all[k] = v
+	}
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	const missing = "\x00"
+	pairs := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		v := all[k]
+		if _, isGroup := groups[k]; v == "" && !isGroup {
+			v = missing
+		}
+		pairs = append(pairs, k, v)
+	}
+	out := strings.NewReplacer(pairs...).Replace(base)
+	if strings.Contains(out, missing) {
+		return "", false
+	}
+	return out, true
+}
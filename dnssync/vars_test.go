@@ -0,0 +1,87 @@
+package dnssync
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/godo"
+)
+
+func TestReplaceDefaults(t *testing.T) {
+	drop := godo.Droplet{Name: "web1", Tags: []string{"env:prod"}, Networks: &godo.Networks{
+		V4: []godo.NetworkV4{{IPAddress: "1.2.3.4", Type: "public"}},
+	}}
+	tests := []struct {
+		base string
+		want string
+		ok   bool
+	}{
+		{"${DROP}.ssdv.win", "web1.ssdv.win", true},
+		{"${PUB6:-$PUB4}", "1.2.3.4", true},
+		{"${PUB4:-$PUB6}", "1.2.3.4", true},
+		{"${TAG:env:-dev}", "prod", true},
+		{"${TAG:team:-ops}.ssdv.win", "ops.ssdv.win", true},
+		// The default is expanded too, and may itself be missing.
+		{"${PUB6:-$PRI4}", "", false},
+		{"$PUB6", "", false},
+		{"${PUB6:-}", "", true},
+		// Not a variable, so only its default applies.
+		{"${NOPE:-$DROP}", "web1", true},
+		{"${NOPE}", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := replace(tt.base, drop, nil, nil)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("replace(%q) = %q, %v, want %q, %v", tt.base, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestReplaceModifiers(t *testing.T) {
+	drop := godo.Droplet{ID: 42, Name: "Web_1.Lab", Tags: []string{"env:Staging"}, Region: &godo.Region{Slug: "nyc3"}}
+	tests := []struct {
+		base string
+		want string
+		ok   bool
+	}{
+		{"${DROP|label}.ssdv.win", "web-1-lab.ssdv.win", true},
+		{"${DROP|lower}", "web_1.lab", true},
+		{"${TAG:env|lower}.ssdv.win", "staging.ssdv.win", true},
+		// Modifiers apply to the default as well.
+		{"${TAG:team|lower:-OPS}", "ops", true},
+		{"${TAG:team|label:-$DROP}", "web-1-lab", true},
+		{"${DROP|lower|label}", "web-1-lab", true},
+		{"$REGION-$ID", "nyc3-42", true},
+		{"${TAG:team|lower}", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := replace(tt.base, drop, nil, nil)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("replace(%q) = %q, %v, want %q, %v", tt.base, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHostLabel(t *testing.T) {
+	tests := map[string]string{
+		"Web_1":                 "web-1",
+		"-edge.node-":           "edge-node",
+		"a..b":                  "a-b",
+		strings.Repeat("x", 70): strings.Repeat("x", 63),
+	}
+	for in, want := range tests {
+		if got := hostLabel(in); got != want {
+			t.Errorf("hostLabel(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCheckModifiers(t *testing.T) {
+	if err := checkModifiers("${DROP|label}.${TAG:env|lower:-dev}"); err != nil {
+		t.Error(err)
+	}
+	_, _, err := parseRules("names.cfg", []byte("A ${DROP|upper}.ssdv.win $PUB4\n"))
+	if err == nil || !strings.Contains(err.Error(), "Unknown modifier 'upper'") {
+		t.Errorf("err = %v, want an unknown modifier", err)
+	}
+}
@@ -0,0 +1,281 @@
+package dnssync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+// skipUnchangedFor, when set, skips zones whose desired records hash the
+// same as at their last successful sync, for up to this long, to save API
+// calls. Drift made outside this tool is only corrected once it expires.
+var skipUnchangedFor = envDuration("SKIP_UNCHANGED_FOR", 0)
+
+type zoneSync struct {
+	hash string
+	at   time.Time
+}
+
+var lastZoneSync = map[string]zoneSync{}
+
+// zoneStateMu guards lastZoneSync, managedZones and ownedRecords, which the
+// zones ZONE_CONCURRENCY syncs at once read and update.
+var zoneStateMu sync.RWMutex
+
+func zoneHash(dc *models.DomainConfig) string {
+	lines := []string{zoneProvider(dc)}
+	for _, rec := range dc.Records {
+		lines = append(lines, recordString(rec))
+	}
+	sort.Strings(lines[1:])
+	h := sha256.New()
+	for _, l := range lines {
+		h.Write([]byte(l + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// zoneUnchanged reports whether dc can be skipped because it matches what
+// was last synced recently enough.
+func zoneUnchanged(dc *models.DomainConfig) bool {
+	if skipUnchangedFor <= 0 {
+		return false
+	}
+	zoneStateMu.RLock()
+	last, ok := lastZoneSync[dc.Name]
+	zoneStateMu.RUnlock()
+	return ok && last.hash == zoneHash(dc) && time.Since(last.at) < skipUnchangedFor
+}
+
+// settlePeriod, when set, delays applying a desired state that differs from
+// the last sync's: the droplets are listed and evaluated again after this
+// long, and the second result is applied, so a deploy in progress doesn't
+// cause a write for every intermediate state.
+var settlePeriod = envDuration("SETTLE_PERIOD", 0)
+
+// lastDesired holds the hash of each zone's desired records at the last
+// sync. It is nil before the first sync, which doesn't settle.
+var lastDesired map[string]string
+
+// desiredChanged reports whether domains differ from the desired state of
+// the last sync.
+func desiredChanged(domains map[string]*models.DomainConfig) bool {
+	if lastDesired == nil {
+		return false
+	}
+	if len(domains) != len(lastDesired) {
+		return true
+	}
+	for name, dc := range domains {
+		if lastDesired[name] != zoneHash(dc) {
+			return true
+		}
+	}
+	return false
+}
+
+func markDesired(domains map[string]*models.DomainConfig) {
+	lastDesired = map[string]string{}
+	for name, dc := range domains {
+		lastDesired[name] = zoneHash(dc)
+	}
+}
+
+func markZoneSynced(dc *models.DomainConfig) {
+	if skipUnchangedFor > 0 {
+		zoneStateMu.Lock()
+		defer zoneStateMu.Unlock()
+		lastZoneSync[dc.Name] = zoneSync{hash: zoneHash(dc), at: time.Now()}
+	}
+}
+
+// stateFile, when set, persists the zones this tool manages, and the
+// droplet count deletions are held against, across restarts.
+var stateFile = os.Getenv("STATE_FILE")
+
+// managedZones maps each zone this tool has synced records into to its
+// provider. A zone that no rule produces records for anymore is still
+// reconciled, so the records of removed rules get deleted.
+var managedZones = map[string]string{}
+
+// managedState is the contents of stateFile: the managed zones and the
+// droplet count dropletsShrank last accepted.
+type managedState struct {
+	Zones    map[string]string `json:"zones"`
+	Droplets int               `json:"droplets,omitempty"`
+}
+
+// loadManagedZones reads stateFile. A file that is only the zones map, as
+// older versions wrote it, is read as that.
+func loadManagedZones() error {
+	if stateFile == "" {
+		return nil
+	}
+	dat, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state managedState
+	if err := json.Unmarshal(dat, &state); err != nil {
+		return err
+	}
+	zoneStateMu.Lock()
+	defer zoneStateMu.Unlock()
+	if state.Zones == nil {
+		return json.Unmarshal(dat, &managedZones)
+	}
+	managedZones, lastDropletCount = state.Zones, state.Droplets
+	return nil
+}
+
+// saveManagedZones writes stateFile. The caller holds zoneStateMu.
+func saveManagedZones() error {
+	if stateFile == "" {
+		return nil
+	}
+	dat, err := json.MarshalIndent(managedState{Zones: managedZones, Droplets: lastDropletCount}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(stateFile, dat, 0644)
+}
+
+// addAbandonedZones adds an empty config to domains for every managed zone
+// that no longer has any records, so the records this tool left there are
+// cleaned up. It only does so under Prune or TXT_OWNER_ID, which limit the
+// deletions to records this tool owns; otherwise emptying a zone would
+// take every record made by hand with it.
+func addAbandonedZones(domains map[string]*models.DomainConfig) {
+	if !cfg.Prune && txtOwnerID == "" {
+		return
+	}
+	zoneStateMu.RLock()
+	defer zoneStateMu.RUnlock()
+	for zone, provider := range managedZones {
+		if domains[zone] != nil || !zoneSelected(zone) || !zoneCfg.zoneAllowed(zone) || (zoneCfg.AppendOnly[zone] && !cfg.Reconcile) {
+			continue
+		}
+		slog.Warn("No rules produce records in zone anymore; removing the records this tool owns", "zone", zone)
+		domains[zone] = &models.DomainConfig{
+			Name:         zone,
+			DNSProviders: map[string]int{provider: 0},
+		}
+	}
+}
+
+// markZoneManaged records that dc was synced, forgetting zones that were
+// synced empty.
+func markZoneManaged(dc *models.DomainConfig) {
+	zoneStateMu.Lock()
+	defer zoneStateMu.Unlock()
+	if len(dc.Records) == 0 {
+		delete(managedZones, dc.Name)
+	} else {
+		managedZones[dc.Name] = zoneProvider(dc)
+	}
+	if err := saveManagedZones(); err != nil {
+		slog.Error("Error saving state", "file", stateFile, "error", err)
+	}
+}
+
+// ownedFile, when set, persists ownedRecords across restarts. Without it a
+// restarted -prune sync deletes nothing until the records are synced again.
+var ownedFile = os.Getenv("OWNED_RECORDS_FILE")
+
+// ownedRecords maps each zone to the records, as "TYPE name", this tool has
+// synced into it, which are the only ones a Prune sync deletes.
+var ownedRecords = map[string]map[string]bool{}
+
+func loadOwnedRecords() error {
+	if ownedFile == "" {
+		return nil
+	}
+	dat, err := ioutil.ReadFile(ownedFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	zones := map[string][]string{}
+	if err := json.Unmarshal(dat, &zones); err != nil {
+		return err
+	}
+	for zone, keys := range zones {
+		ownedRecords[zone] = map[string]bool{}
+		for _, key := range keys {
+			ownedRecords[zone][key] = true
+		}
+	}
+	return nil
+}
+
+func saveOwnedRecords() error {
+	if ownedFile == "" {
+		return nil
+	}
+	zones := map[string][]string{}
+	for zone, owned := range ownedRecords {
+		for key := range owned {
+			zones[zone] = append(zones[zone], key)
+		}
+		sort.Strings(zones[zone])
+	}
+	dat, err := json.MarshalIndent(zones, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ownedFile, dat, 0644)
+}
+
+// ownedKey identifies a record of type typ named name in ownedRecords.
+func ownedKey(typ, name string) string {
+	return typ + " " + canonicalName(name)
+}
+
+// ownsRecord reports whether the record the deletion c acts on in zone was
+// synced by this tool.
+func ownsRecord(zone string, c *models.Correction) bool {
+	zoneStateMu.RLock()
+	defer zoneStateMu.RUnlock()
+	return ownedRecords[zone][ownedKey(correctionType(c), correctionName(c))]
+}
+
+// markZoneOwned records that the records of dc were synced, and forgets the
+// ones the corrections in done, as "zone: correction", deleted.
+func markZoneOwned(dc *models.DomainConfig, done []string) {
+	zoneStateMu.Lock()
+	defer zoneStateMu.Unlock()
+	owned := ownedRecords[dc.Name]
+	if owned == nil {
+		owned = map[string]bool{}
+		ownedRecords[dc.Name] = owned
+	}
+	for _, a := range done {
+		c := &models.Correction{Msg: strings.TrimPrefix(a, dc.Name+": ")}
+		if a != c.Msg && isDelete(c) {
+			delete(owned, ownedKey(correctionType(c), correctionName(c)))
+		}
+	}
+	for _, rec := range dc.Records {
+		owned[ownedKey(rec.Type, rec.NameFQDN)] = true
+	}
+	if len(owned) == 0 {
+		delete(ownedRecords, dc.Name)
+	}
+	if err := saveOwnedRecords(); err != nil {
+		slog.Error("Error saving state", "file", ownedFile, "error", err)
+	}
+}
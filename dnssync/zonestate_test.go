@@ -0,0 +1,44 @@
+package dnssync
+
+import (
+	"testing"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+func TestAddAbandonedZonesNeedsOwnership(t *testing.T) {
+	defer func(c Config, id string, m map[string]string) {
+		cfg, txtOwnerID, managedZones = c, id, m
+	}(cfg, txtOwnerID, managedZones)
+	managedZones = map[string]string{"old.win": "digitalocean"}
+	cfg, txtOwnerID = Config{}, ""
+	domains := map[string]*models.DomainConfig{}
+	addAbandonedZones(domains)
+	if domains["old.win"] != nil {
+		t.Errorf("emptied an abandoned zone without -prune or TXT_OWNER_ID")
+	}
+	cfg.Prune = true
+	addAbandonedZones(domains)
+	if domains["old.win"] == nil {
+		t.Errorf("didn't clean up an abandoned zone under -prune")
+	}
+}
+
+func TestAbandonedZoneKeepsUnownedRecords(t *testing.T) {
+	defer func(c Config, o map[string]map[string]bool) { cfg, ownedRecords = c, o }(cfg, ownedRecords)
+	cfg = Config{Prune: true}
+	ownedRecords = map[string]map[string]bool{"old.win": {ownedKey("A", "web.old.win"): true}}
+	dc := &models.DomainConfig{Name: "old.win"}
+	corrs := []*models.Correction{
+		{Msg: "DELETE A web.old.win 1.2.3.4 ttl=100"},
+		{Msg: "DELETE A manual.old.win 5.6.7.8 ttl=100"},
+		{Msg: `DELETE TXT old.win "v=spf1 -all" ttl=100`},
+	}
+	kept := filterCorrections(dc, corrs, false)
+	if len(kept) != 1 || kept[0] != corrs[0] {
+		for _, c := range kept {
+			t.Logf("kept %s", c.Msg)
+		}
+		t.Errorf("want only the owned record deleted")
+	}
+}
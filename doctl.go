@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// doctlToken returns the access token doctl is authenticated with, read from
+// its config.yaml, or "" if there is none. The config is simple enough that
+// its few top-level keys are read line by line rather than pulling in a YAML
+// parser.
+func doctlToken() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	dat, err := ioutil.ReadFile(filepath.Join(dir, "doctl", "config.yaml"))
+	if err != nil {
+		return ""
+	}
+	var token, context string
+	contexts := map[string]string{}
+	inContexts := false
+	for _, line := range strings.Split(string(dat), "\n") {
+		indented := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		kv := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+		switch {
+		case indented && inContexts:
+			contexts[key] = value
+		case indented:
+		case key == "auth-contexts":
+			inContexts = true
+			continue
+		case key == "access-token":
+			token = value
+		case key == "context":
+			context = value
+		}
+		if !indented {
+			inContexts = false
+		}
+	}
+	if context != "" && context != "default" {
+		return contexts[context]
+	}
+	return token
+}
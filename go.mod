@@ -0,0 +1,35 @@
+module github.com/captncraig/do-dns-sync
+
+go 1.26
+
+require (
+	// The last releases with the RecordConfig fields this code uses
+	// (NameFQDN, exported Target, TxtStrings) and Correction{F, Msg}. This
+	// tag also has providers.CreateDNSProvider(type, config, meta),
+	// digitalocean.NewDo, and the CLOUDFLAREAPI (apikey and apiuser only)
+	// and ROUTE53 providers that providerFactories builds.
+	github.com/StackExchange/dnscontrol v0.2.3
+	github.com/digitalocean/godo v1.212.0
+	github.com/miekg/dns v1.1.50
+	github.com/prometheus/client_golang v1.19.1
+	golang.org/x/net v0.59.0
+	golang.org/x/oauth2 v0.37.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/google/go-querystring v1.1.0 // indirect
+	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
+	github.com/hashicorp/go-retryablehttp v0.7.7 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/mod v0.41.0 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
+	golang.org/x/time v0.6.0 // indirect
+	golang.org/x/tools v0.49.0 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+)
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logDedupWindow is how long an identical log line is suppressed after it
+// is first written, set with LOG_DEDUP_WINDOW, like 5m. It is zero, which
+// disables deduplication, by default, so no line is ever hidden unasked.
+var logDedupWindow time.Duration
+
+// dedupWriter writes log lines to out, dropping repeats of a line within
+// window. When a suppressed line recurs after the window it is written once
+// more with a count of how often it happened in the meantime; lines that
+// don't recur are forgotten once the window passes, with a count of their
+// repeats written along with the next line.
+type dedupWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	window time.Duration
+	seen   map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	first      time.Time
+	suppressed int
+}
+
+func newDedupWriter(out io.Writer, window time.Duration) *dedupWriter {
+	return &dedupWriter{out: out, window: window, seen: map[string]*dedupEntry{}}
+}
+
+func (w *dedupWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	msg := string(p)
+	e := w.seen[msg]
+	if e != nil && now.Sub(e.first) < w.window {
+		e.suppressed++
+		return len(p), nil
+	}
+	stamp := now.Format("2006/01/02 15:04:05 ")
+	var out []string
+	for k, old := range w.seen {
+		if now.Sub(old.first) < w.window {
+			continue
+		}
+		delete(w.seen, k)
+		if old.suppressed > 0 && k != msg {
+			out = append(out, stamp+fmt.Sprintf("repeated %dx: %s", old.suppressed, k))
+		}
+	}
+	sort.Strings(out)
+	if e != nil && e.suppressed > 0 {
+		msg = fmt.Sprintf("still happening (%dx): %s", e.suppressed+1, msg)
+	}
+	w.seen[string(p)] = &dedupEntry{first: now}
+	if _, err := io.WriteString(w.out, strings.Join(out, "")+stamp+msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logLevels are the values of LOG_LEVEL.
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// setupLogging installs the slog handler per LOG_FORMAT and LOG_LEVEL. Text
+// logs (the default) go through the deduplicating writer when
+// LOG_DEDUP_WINDOW is set, which writes its own timestamps so identical
+// messages compare equal. JSON logs, one object per line for log pipelines,
+// aren't deduplicated; they carry the change report too.
+func setupLogging() {
+	if v := os.Getenv("LOG_DEDUP_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid LOG_DEDUP_WINDOW '%s': %s", v, err)
+		}
+		logDedupWindow = d
+	}
+	level, ok := slog.LevelInfo, true
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		level, ok = logLevels[strings.ToLower(v)]
+	}
+	if !ok {
+		log.Fatalf("Invalid LOG_LEVEL '%s', must be debug, info, warn or error", os.Getenv("LOG_LEVEL"))
+	}
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+		return
+	case "", "text":
+	default:
+		log.Fatalf("Invalid LOG_FORMAT '%s', must be text or json", format)
+	}
+	// slog's default handler writes its entries to the log output as text,
+	// prefixed with their level.
+	slog.SetLogLoggerLevel(level)
+	if logDedupWindow > 0 {
+		log.SetFlags(0)
+		log.SetOutput(newDedupWriter(os.Stderr, logDedupWindow))
+	}
+}
+
+// fatal logs v at the error level, so LOG_LEVEL never hides it, and exits.
+func fatal(v ...interface{}) {
+	slog.Error(fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+// fatalf is fatal with a format.
+func fatalf(format string, v ...interface{}) {
+	fatal(fmt.Sprintf(format, v...))
+}
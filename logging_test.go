@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupWriterForgetsExpiredLines(t *testing.T) {
+	var buf bytes.Buffer
+	w := newDedupWriter(&buf, 20*time.Millisecond)
+	w.Write([]byte("a\n"))
+	w.Write([]byte("a\n"))
+	w.Write([]byte("a\n"))
+	w.Write([]byte("b\n"))
+	time.Sleep(30 * time.Millisecond)
+	w.Write([]byte("c\n"))
+	if len(w.seen) != 1 || w.seen["c\n"] == nil {
+		t.Errorf("seen = %v, want only c", w.seen)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var got []string
+	for _, line := range lines {
+		// Drop the timestamp.
+		got = append(got, line[len("2006/01/02 15:04:05 "):])
+	}
+	want := []string{"a", "b", "repeated 2x: a", "c"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDedupWriterCountsRecurringLines(t *testing.T) {
+	var buf bytes.Buffer
+	w := newDedupWriter(&buf, 20*time.Millisecond)
+	w.Write([]byte("a\n"))
+	w.Write([]byte("a\n"))
+	time.Sleep(30 * time.Millisecond)
+	w.Write([]byte("a\n"))
+	if !strings.Contains(buf.String(), "still happening (2x): a\n") {
+		t.Errorf("got %q, want a count of the recurring line", buf.String())
+	}
+	if strings.Contains(buf.String(), "repeated") {
+		t.Errorf("got %q, with a separate summary of the recurring line", buf.String())
+	}
+}
+
+func TestSetupLoggingDedupOffByDefault(t *testing.T) {
+	defer func(w io.Writer, f int, d time.Duration) {
+		log.SetOutput(w)
+		log.SetFlags(f)
+		logDedupWindow = d
+		slog.SetLogLoggerLevel(slog.LevelInfo)
+	}(log.Writer(), log.Flags(), logDedupWindow)
+	t.Setenv("LOG_FORMAT", "")
+	t.Setenv("LOG_LEVEL", "")
+	for _, tt := range []struct {
+		window string
+		dedup  bool
+	}{{"", false}, {"0", false}, {"5m", true}} {
+		log.SetOutput(os.Stderr)
+		logDedupWindow = 0
+		t.Setenv("LOG_DEDUP_WINDOW", tt.window)
+		setupLogging()
+		if _, ok := log.Writer().(*dedupWriter); ok != tt.dedup {
+			t.Errorf("LOG_DEDUP_WINDOW=%q: deduplicating = %v, want %v", tt.window, ok, tt.dedup)
+		}
+	}
+}
@@ -2,250 +2,120 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"log/slog"
+	"math"
 	"os"
-	"regexp"
-	"strconv"
-	"strings"
-	"time"
 
-	"github.com/StackExchange/dnscontrol/providers/digitalocean"
-	"github.com/miekg/dns/dnsutil"
-
-	"github.com/StackExchange/dnscontrol/models"
-	"github.com/digitalocean/godo"
-	"golang.org/x/net/publicsuffix"
-	"golang.org/x/oauth2"
+	"github.com/captncraig/do-dns-sync/dnssync"
 )
 
-var token = os.Getenv("DO_TOKEN")
-
-type TokenSource struct {
-	AccessToken string
-}
+var (
+	showVersion    = flag.Bool("version", false, "print version information and exit")
+	printConfig    = flag.Bool("print-config", false, "print the parsed config, with defaults and includes applied, and exit")
+	check          = flag.Bool("check", false, "check that the config loads, reporting the line of any problem, and exit")
+	once           = flag.Bool("once", false, "run a single sync and exit")
+	lint           = flag.Bool("lint", false, "check the config for rules that can produce the same name and type, and exit")
+	testDroplet    = flag.String("test-droplet", "", "print the records the config produces for a droplet with this name, or for a JSON droplet read from stdin if '-', and exit")
+	preflightCheck = flag.Bool("preflight", false, "check the config against the account's droplets and domains without changing anything, and exit")
+	importZone     = flag.String("import", "", "print names.cfg rules for the existing records in this zone and exit")
+	listen         = flag.String("listen", os.Getenv("DO_DNS_LISTEN"), "serve /metrics, /healthz, /readyz and POST /sync on this address, like :9101 (or set DO_DNS_LISTEN); POST /sync needs SYNC_TRIGGER_TOKEN unless the address is loopback")
+	ttl            = flag.Uint("ttl", 0, "TTL of records whose rule and zone give none (default DEFAULT_TTL, or 100)")
+	planExitCode   = flag.Int("plan-exit-code", 2, "exit status of -plan and -dry-run when there are changes, or 0 to always succeed")
+)
 
-func (t *TokenSource) Token() (*oauth2.Token, error) {
-	token := &oauth2.Token{
-		AccessToken: t.AccessToken,
-	}
-	return token, nil
+var cfg dnssync.Config
+
+func init() {
+	flag.DurationVar(&cfg.Interval, "interval", 0, "time between syncs (default SYNC_INTERVAL, or 30s)")
+	flag.StringVar(&cfg.Rules, "config", "", "path or URL of the names config, in the JSON format if it ends in .json (default NAMES_CFG, or names.cfg)")
+	flag.StringVar(&cfg.Zone, "zone", "", "only sync records in this zone")
+	flag.StringVar(&cfg.OnlyRule, "only", "", "only sync the records of the rule with this id")
+	flag.StringVar(&cfg.OnlyTag, "only-tag", "", "only sync the records of rules matching this droplet tag")
+	flag.BoolVar(&cfg.Interactive, "interactive", false, "run a single sync, asking for confirmation before applying deletions")
+	flag.BoolVar(&cfg.Prune, "prune", false, "only delete records this tool has synced before (tracked in OWNED_RECORDS_FILE), leaving records made by hand alone")
+	flag.BoolVar(&cfg.Reconcile, "reconcile", false, "run a single sync that applies deletions despite NO_DELETE, REPORT_DELETES, append-only zones and deletion caps")
+	flag.BoolVar(&cfg.Plan, "plan", false, "print the changes a sync would make as JSON on stdout instead of applying them")
+	flag.BoolVar(&cfg.DryRun, "dry-run", os.Getenv("DO_DNS_DRYRUN") != "", "run a single sync that reports the changes it would make instead of applying them (or set DO_DNS_DRYRUN)")
+	flag.StringVar(&cfg.Export, "export", "", "write the computed records to this dnscontrol file (.json for JSON, otherwise dnsconfig.js) instead of applying them")
+	flag.BoolVar(&cfg.ZoneFile, "zonefile", false, "print the computed records as BIND zone files on stdout instead of applying them")
 }
 
-func runOnce() error {
-	tokenSource := &TokenSource{
-		AccessToken: token,
-	}
-	oauthClient := oauth2.NewClient(context.Background(), tokenSource)
-	client := godo.NewClient(oauthClient)
-
-	drops, err := DropletList(client)
-	if err != nil {
-		return err
+func main() {
+	flag.Parse()
+	setupLogging()
+	if *showVersion {
+		fmt.Println(versionString())
+		return
 	}
-
-	rules, err := LoadRules()
-	if err != nil {
-		return err
+	slog.Info("Starting", "version", version, "commit", commit, "built", date)
+	cfg.Version = version
+	if *ttl > math.MaxInt32 {
+		fatalf("-ttl must be at most %d", math.MaxInt32)
 	}
-
-	domains := map[string]*models.DomainConfig{}
-
-	for _, drop := range drops {
-		for _, rule := range rules {
-			if rule.Label != "" {
-				hasTag := false
-				for _, t := range drop.Tags {
-					if t == rule.Label {
-						hasTag = true
-						break
-					}
-				}
-				if !hasTag {
-					continue
-				}
-			}
-			var matches []string
-			if rule.Regex != nil {
-				matches = rule.Regex.FindStringSubmatch(drop.Name)
-				if len(matches) == 0 {
-					continue
-				}
-			}
-			rec := &models.RecordConfig{
-				Type:     rule.Type,
-				NameFQDN: replace(rule.FQDN, drop, matches),
-				Target:   replace(rule.Target, drop, matches),
-				TTL:      100,
-			}
-			sld, err := publicsuffix.EffectiveTLDPlusOne(rec.NameFQDN)
-			if err != nil {
-				return err
-			}
-			rec.Name = dnsutil.TrimDomainName(rec.NameFQDN, sld)
-			if rule.Type == "SRV" {
-				rec.SrvPort = uint16(rule.Port)
-				rec.SrvWeight = 10
-				rec.SrvPriority = 10
-			}
-			if domains[sld] == nil {
-				domains[sld] = &models.DomainConfig{
-					Name: sld,
-				}
-			}
-			domains[sld].Records = append(domains[sld].Records, rec)
+	cfg.TTL = uint32(*ttl)
+	if *printConfig {
+		if err := dnssync.PrintConfig(cfg); err != nil {
+			fatal(err)
 		}
+		return
 	}
-	provider, err := digitalocean.NewDo(map[string]string{"token": token}, nil)
-	if err != nil {
-		return err
-	}
-	for _, dc := range domains {
-		fmt.Println("-----", dc.Name)
-		corrs, err := provider.GetDomainCorrections(dc)
-		if err != nil {
-			return err
+	if *check {
+		if err := dnssync.Check(cfg); err != nil {
+			fatal(err)
 		}
-		for _, c := range corrs {
-			if strings.Contains(c.Msg, "DELETE NS") {
-				continue
-			}
-			err = c.F()
-			fmt.Println(c.Msg, err)
-			if err != nil {
-				return err
-			}
+		return
+	}
+	if *lint {
+		if err := dnssync.Lint(cfg); err != nil {
+			fatal(err)
 		}
+		return
 	}
-	return nil
-}
-
-func main() {
-	if token == "" {
-		log.Fatal("DO_TOKEN env var is required")
+	if *testDroplet != "" {
+		if err := dnssync.TestDroplet(cfg, *testDroplet); err != nil {
+			fatal(err)
+		}
+		return
 	}
-	for {
-		start := time.Now()
-		err := runOnce()
-		if err != nil {
-			log.Printf("Error running dns sync: %s", err)
+	cfg.Token = os.Getenv("DO_TOKEN")
+	refreshing := os.Getenv("DO_REFRESH_TOKEN") != ""
+	if cfg.Token == "" && !refreshing {
+		if cfg.Token = doctlToken(); cfg.Token != "" {
+			slog.Info("DO_TOKEN not set, using the doctl access token")
 		}
-		log.Printf("Synced records in %s", time.Now().Sub(start))
-		time.Sleep(30 * time.Second)
 	}
-}
-
-func replace(base string, drop godo.Droplet, matches []string) string {
-	base = strings.Replace(base, "$DROP", drop.Name, -1)
-	pub4, _ := drop.PublicIPv4()
-	base = strings.Replace(base, "$PUB4", pub4, -1)
-	pri4, _ := drop.PrivateIPv4()
-	base = strings.Replace(base, "$PRI4", pri4, -1)
-	pub6, _ := drop.PublicIPv6()
-	base = strings.Replace(base, "$PUB6", pub6, -1)
-	for i := 1; i < len(matches); i++ {
-		base = strings.Replace(base, fmt.Sprintf("$%d", i), matches[i], -1)
+	if cfg.Token == "" && !refreshing {
+		fatal("DO_TOKEN env var is required, or DO_REFRESH_TOKEN or a doctl login")
 	}
-	return base
-}
-
-func DropletList(client *godo.Client) ([]godo.Droplet, error) {
-	list := []godo.Droplet{}
-	opt := &godo.ListOptions{}
-	for {
-		droplets, resp, err := client.Droplets.List(context.Background(), opt)
-		if err != nil {
-			return nil, err
+	ctx := context.Background()
+	if *preflightCheck {
+		if err := dnssync.Preflight(ctx, cfg); err != nil {
+			fatal(err)
 		}
-		list = append(list, droplets...)
-		if resp.Links == nil || resp.Links.IsLastPage() {
-			break
-		}
-		page, err := resp.Links.CurrentPage()
-		if err != nil {
-			return nil, err
+		return
+	}
+	if *importZone != "" {
+		if err := dnssync.Import(ctx, cfg, *importZone); err != nil {
+			fatal(err)
 		}
-		opt.Page = page + 1
+		return
 	}
-	return list, nil
-}
-
-type NameRule struct {
-	Type   string
-	FQDN   string
-	Target string
-	Port   int
-	Label  string
-	Regex  *regexp.Regexp
-}
-
-func LoadRules() ([]*NameRule, error) {
-	// TODO: test this harder
-	dat, err := ioutil.ReadFile("names.cfg")
-	if err != nil {
-		return nil, err
+	if *listen != "" {
+		go func() {
+			fatal(dnssync.ServeMetrics(*listen))
+		}()
 	}
-	rules := []*NameRule{}
-	for _, line := range strings.Split(string(dat), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" || line[0] == '#' {
-			continue
-		}
-		parts := strings.Split(line, " ")
-		if len(parts) < 3 {
-			return nil, fmt.Errorf("Each name rule needs at least '$TYPE $FQDN $TARGET")
-		}
-		rule := &NameRule{
-			Type:   parts[0],
-			FQDN:   parts[1],
-			Target: parts[2],
-		}
-		parts = parts[3:]
-		if rule.Type != "A" && rule.Type != "AAAA" && rule.Type != "SRV" {
-			return nil, fmt.Errorf("Unknown rule record type '%s'", rule.Type)
-		}
-		if len(parts) == 0 && rule.Type == "SRV" {
-			return nil, fmt.Errorf("SRV rule needs at least '$TYPE $FQDN $TARGET $PORT")
-		}
-		if rule.Type == "SRV" {
-			rule.Port, err = strconv.Atoi(parts[0])
-			if err != nil {
-				return nil, err
-			}
-			parts = parts[1:]
-		}
-		if len(parts) > 1 {
-			return nil, fmt.Errorf("Too many parts in rule")
+	if *once || cfg.Interactive || cfg.Export != "" || cfg.ZoneFile || cfg.Plan || cfg.DryRun || cfg.Reconcile {
+		sum, err := dnssync.Sync(ctx, cfg)
+		if err != nil {
+			fatalf("Error running dns sync: %s", err)
 		}
-		if len(parts) == 1 {
-			if label := strings.TrimSuffix(strings.TrimPrefix(parts[0], "["), "]"); label != parts[0] {
-				rule.Label = label
-			} else if rex := strings.Trim(parts[0], "`"); rex != parts[0] {
-				rule.Regex, err = regexp.Compile(rex)
-				if err != nil {
-					return nil, err
-				}
-			}
+		if (cfg.Plan || cfg.DryRun) && sum.Planned > 0 && *planExitCode != 0 {
+			os.Exit(*planExitCode)
 		}
-		rules = append(rules, rule)
+		return
 	}
-	return rules, nil
+	fatal(dnssync.Run(ctx, cfg))
 }
-
-/*
-
-A $DROP.ssdv.win $PUB4
-A $DROP.pvt.ssdv.win $PRI4
-AAAA $DROP.ssdv.win $PUB6
-SRV _mysql._tcp.pvt.ssdv.win $DROP.pvt.ssdv.win. 9104 [mysql]
-SRV _node._tcp.pvt.ssdv.win $DROP.pvt.ssdv.win. 9100
-A *.$1.ssdv.win $PUB4 `[a-z][a-z]\-([a-z]+)\d\d`
-# dc-service.ssdv.win only (essentially without number)
-#A $1.ssdv.win $PUB4 `([a-z][a-z]\-[a-z]+)\d\d`
-#A $1.pvt.ssdv.win $PRI4 `([a-z][a-z]\-[a-z]+)\d\d`
-# service.ssdv.win (across all dcs)
-#A $1.ssdv.win $PUB4 `[a-z][a-z]\-([a-z]+)\d\d`
-#A $1.pvt.ssdv.win $PRI4 `[a-z][a-z]\-([a-z]+)\d\d`
-
-*/
@@ -0,0 +1,14 @@
+package main
+
+import "fmt"
+
+// Build metadata, injected with -ldflags "-X main.version=...".
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("do-dns-sync %s (commit %s, built %s)", version, commit, date)
+}